@@ -1,34 +1,91 @@
 package auth
 
 import (
-	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
-	"github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/configuration"
+	"github.com/stefan-chivu/gochat/gochat/store"
 )
 
-var store *sessions.CookieStore
+// Authenticator establishes the identity of the users of a server, with session cookies, bearer
+// tokens or, in InsecureDevMode, a username form value. Every server owns its own, so servers with
+// different configurations and stores can run side by side.
+type Authenticator struct {
+	cookieStore *sessions.CookieStore
+
+	// tokenKeys sign and verify tokens. The first key signs new tokens.
+	tokenKeys       [][]byte
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+
+	// users holds the registered accounts.
+	users store.UserStore
+	// revoked holds the refresh tokens that were used or revoked.
+	revoked store.TokenStore
+	// refreshMu makes checking and revoking a refresh token atomic so it can only be used once.
+	refreshMu sync.Mutex
+
+	// allowedOrigins are the origins allowed to make credentialed cross-origin requests.
+	allowedOrigins map[string]bool
+	// insecureDevMode lets clients pick their identity with the username query parameter instead
+	// of logging in. It must only be enabled for local development.
+	insecureDevMode bool
+}
+
+// NewAuthenticator sets up the session cookies, tokens and allowed origins described by config.
+// Accounts are registered and looked up in users, and used refresh tokens are recorded in tokens.
+func NewAuthenticator(config *configuration.ServerConfig, users store.UserStore, tokens store.TokenStore) (*Authenticator, error) {
+	a := &Authenticator{
+		users:           users,
+		revoked:         tokens,
+		allowedOrigins:  parseAllowedOrigins(config.AllowedOrigins),
+		insecureDevMode: config.InsecureDevMode,
+	}
+	if err := a.setupCookieStore(config); err != nil {
+		return nil, fmt.Errorf("failed to set up session cookies: %v", err)
+	}
+	if err := a.setupTokens(config); err != nil {
+		return nil, fmt.Errorf("failed to set up tokens: %v", err)
+	}
+
+	return a, nil
+}
 
-func NewCookieStore() error {
-	key := make([]byte, 64)
+// setupCookieStore sets up the session cookie store with the keys and cookie options of config.
+func (a *Authenticator) setupCookieStore(config *configuration.ServerConfig) error {
+	keyPairs, err := parseSessionKeys(config.SessionKeys)
+	if err != nil {
+		return err
+	}
+	if len(keyPairs) == 0 {
+		config.Log.Warn().Msg("No session keys configured; using random keys, sessions will not survive restarts")
+		if keyPairs, err = randomSessionKeys(); err != nil {
+			return err
+		}
+	}
 
-	_, err := rand.Read(key)
+	options, err := cookieOptions(config)
 	if err != nil {
 		return err
 	}
 
-	store = sessions.NewCookieStore(key)
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = options
+	store.MaxAge(options.MaxAge)
+	a.cookieStore = store
 
 	return nil
 }
 
+// Secret must be served behind RequireUser.
 func Secret(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "cookie-name")
-
 	// Check if user is authenticated
-	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+	if _, ok := ContextUser(r.Context()); !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -37,10 +94,38 @@ func Secret(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "The cake is a lie!")
 }
 
-func Login(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "cookie-name")
+func (a *Authenticator) Register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.RegisterUser(r.Form.Get("username"), r.Form.Get("password"))
+	if err == store.ErrUserExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeUser(w, user.Username)
+}
+
+func (a *Authenticator) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	fmt.Printf("%v", r)
+	session, _ := a.cookieStore.Get(r, sessionName)
 
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Parse form failed", http.StatusBadRequest)
@@ -49,33 +134,60 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	username := r.Form.Get("username")
 
-	// TODO better valid username check
 	if username == "" {
 		// error case
 		http.Error(w, "Invalid username", http.StatusBadRequest)
 		return
 	}
 
-	user := &models.User{Username: username}
-	if authenticateUser(user) {
-		// Set user as authenticated
-		session.Values["authenticated"] = true
-		session.Save(r, w)
+	user, err := a.authenticateUser(username, r.Form.Get("password"))
+	if err == ErrInvalidCredentials {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
 
-		// redirect to whatever
+	// Set user as authenticated
+	session.Values[authenticatedField] = true
+	session.Values[usernameField] = user.Username
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
 	}
+
+	writeUser(w, user.Username)
 }
 
-func Logout(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "cookie-name")
+func (a *Authenticator) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := a.cookieStore.Get(r, sessionName)
 
-	// Revoke users authentication
-	session.Values["authenticated"] = false
-	session.Save(r, w)
+	// Revoke users authentication and have the browser drop the cookie
+	session.Values[authenticatedField] = false
+	delete(session.Values, usernameField)
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func authenticateUser(u *models.User) bool {
-	// TODO: Auth user here
+// writeUser writes the public description of a user.
+func writeUser(w http.ResponseWriter, username string) {
+	responseData, err := json.Marshal(map[string]string{"username": username})
+	if err != nil {
+		http.Error(w, "User JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
 
-	return true
+	w.Write(responseData)
 }
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/stefan-chivu/gochat/gochat/configuration"
+)
+
+// parseSessionKeys decodes the configured session keys into the hash and encryption key pairs
+// expected by sessions.NewCookieStore. A missing encryption key is passed as nil, which leaves
+// cookies signed but not encrypted.
+func parseSessionKeys(entries []string) ([][]byte, error) {
+	var pairs [][]byte
+
+	for i, entry := range entries {
+		hashPart, encPart, _ := strings.Cut(strings.TrimSpace(entry), ":")
+
+		hashKey, err := base64.StdEncoding.DecodeString(hashPart)
+		if err != nil {
+			return nil, fmt.Errorf("session key %d: invalid hash key encoding: %v", i, err)
+		}
+		if len(hashKey) != 32 && len(hashKey) != 64 {
+			return nil, fmt.Errorf("session key %d: hash key must be 32 or 64 bytes, got %d", i, len(hashKey))
+		}
+
+		var encKey []byte
+		if encPart != "" {
+			encKey, err = base64.StdEncoding.DecodeString(encPart)
+			if err != nil {
+				return nil, fmt.Errorf("session key %d: invalid encryption key encoding: %v", i, err)
+			}
+			if len(encKey) != 16 && len(encKey) != 24 && len(encKey) != 32 {
+				return nil, fmt.Errorf("session key %d: encryption key must be 16, 24 or 32 bytes, got %d", i, len(encKey))
+			}
+		}
+
+		pairs = append(pairs, hashKey, encKey)
+	}
+
+	return pairs, nil
+}
+
+// randomSessionKeys generates a single hash and encryption key pair.
+func randomSessionKeys() ([][]byte, error) {
+	hashKey := make([]byte, 64)
+	if _, err := rand.Read(hashKey); err != nil {
+		return nil, err
+	}
+	encKey := make([]byte, 32)
+	if _, err := rand.Read(encKey); err != nil {
+		return nil, err
+	}
+
+	return [][]byte{hashKey, encKey}, nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("unknown SameSite mode '%s'", value)
+}
+
+// cookieOptions builds the attributes of session cookies from the server configuration.
+func cookieOptions(config *configuration.ServerConfig) (*sessions.Options, error) {
+	sameSite, err := parseSameSite(config.SessionSameSite)
+	if err != nil {
+		return nil, err
+	}
+	if sameSite == http.SameSiteNoneMode && !config.SessionSecure {
+		return nil, fmt.Errorf("SameSite=None session cookies must be secure")
+	}
+
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(config.SessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   config.SessionSecure,
+		SameSite: sameSite,
+	}, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// randomKey returns a base64 encoded random key of size bytes.
+func randomKey(t *testing.T, size int) string {
+	t.Helper()
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// login logs the test user in and returns the session cookie.
+func login(t *testing.T, a *Authenticator) *http.Cookie {
+	t.Helper()
+
+	form := url.Values{"username": {testUsername}, "password": {testPassword}}
+	req := httptest.NewRequest(http.MethodPost, "/users/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Login(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("login set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// sessionUser returns the user of the session carried by cookie, or "" if a rejects it.
+func sessionUser(a *Authenticator, cookie *http.Cookie) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	username, err := a.SessionUsername(req)
+	if err != nil {
+		return ""
+	}
+	return username
+}
+
+// TestSessionKeyRotation checks that after a new key is put first, sessions protected by the old
+// key still work while new sessions are protected by the new key.
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey := randomKey(t, 32) + ":" + randomKey(t, 32)
+	newKey := randomKey(t, 64)
+	db := store.NewMemoryStore()
+
+	config := testConfig()
+	config.SessionKeys = []string{oldKey}
+	before := newAuthenticator(t, config, db)
+	if _, err := before.RegisterUser(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	oldSession := login(t, before)
+
+	config = testConfig()
+	config.SessionKeys = []string{newKey, oldKey}
+	rotated := newAuthenticator(t, config, db)
+	if got := sessionUser(rotated, oldSession); got != testUsername {
+		t.Error("the session protected by the old key was rejected after the rotation")
+	}
+
+	newSession := login(t, rotated)
+	if got := sessionUser(before, newSession); got != "" {
+		t.Error("a new session was protected by the old key")
+	}
+	config = testConfig()
+	config.SessionKeys = []string{newKey}
+	newOnly := newAuthenticator(t, config, db)
+	if got := sessionUser(newOnly, newSession); got != testUsername {
+		t.Error("a new session was not protected by the new key")
+	}
+	if got := sessionUser(newOnly, oldSession); got != "" {
+		t.Error("the old session was accepted once the old key was dropped")
+	}
+}
+
+func TestInvalidSessionKeys(t *testing.T) {
+	for name, key := range map[string]string{
+		"not base64":            "not base64!",
+		"short hash key":        randomKey(t, 16),
+		"bad encryption key":    randomKey(t, 32) + ":" + randomKey(t, 20),
+		"encryption key base64": randomKey(t, 32) + ":???",
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig()
+			config.SessionKeys = []string{key}
+			db := store.NewMemoryStore()
+			if _, err := NewAuthenticator(config, db, db); err == nil {
+				t.Error("the key was accepted")
+			}
+		})
+	}
+}
+
+// TestCookieOptions checks the attributes of session cookies built from the configuration, both
+// as computed and as sent by Login.
+func TestCookieOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		sameSite string
+		secure   bool
+		want     http.SameSite
+		invalid  bool
+	}{
+		{name: "default", want: http.SameSiteLaxMode},
+		{name: "lax", sameSite: "Lax", want: http.SameSiteLaxMode},
+		{name: "strict", sameSite: "strict", secure: true, want: http.SameSiteStrictMode},
+		{name: "none", sameSite: "none", secure: true, want: http.SameSiteNoneMode},
+		{name: "none without secure", sameSite: "none", invalid: true},
+		{name: "unknown", sameSite: "sometimes", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.SessionMaxAge = 2 * time.Hour
+			config.SessionSameSite = tt.sameSite
+			config.SessionSecure = tt.secure
+
+			options, err := cookieOptions(config)
+			if tt.invalid {
+				if err == nil {
+					t.Error("the options were accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.Path != "/" || options.MaxAge != 7200 || !options.HttpOnly || options.Secure != tt.secure || options.SameSite != tt.want {
+				t.Errorf("got options %+v", options)
+			}
+
+			a := newAuthenticator(t, config, store.NewMemoryStore())
+			if _, err := a.RegisterUser(testUsername, testPassword); err != nil {
+				t.Fatal(err)
+			}
+			cookie := login(t, a)
+			if cookie.Path != "/" || cookie.MaxAge != 7200 || !cookie.HttpOnly || cookie.Secure != tt.secure || cookie.SameSite != tt.want {
+				t.Errorf("got cookie %+v", cookie)
+			}
+		})
+	}
+}
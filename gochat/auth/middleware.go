@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+type contextKey int
+
+const userKey contextKey = iota
+
+// WithUser returns a copy of ctx carrying user.
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// ContextUser returns the user stored in ctx by RequireUser.
+func ContextUser(ctx context.Context) (*models.User, bool) {
+	user, ok := ctx.Value(userKey).(*models.User)
+	return user, ok && user != nil
+}
+
+// RequestUser returns the account of the user making the request. See RequestUsername for how
+// the identity is established. In insecure dev mode users that never registered are accepted too.
+func (a *Authenticator) RequestUser(r *http.Request) (*models.User, error) {
+	username, err := a.RequestUsername(r)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.users.User(username)
+	if err == store.ErrUserNotFound {
+		if a.insecureDevMode {
+			return &models.User{Username: username}, nil
+		}
+		// The account was removed after the session or token was issued.
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The handlers have no use for the password hash; keep it out of the request.
+	account := *user
+	account.PasswordHash = ""
+	return &account, nil
+}
+
+// RequireUser only lets authenticated requests through to next, with the user injected in the
+// request context. Other requests are answered with 401 Unauthorized.
+func (a *Authenticator) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.RequestUser(r)
+		if err == ErrUnauthenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gochat"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load user", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// RequireUserFunc is RequireUser for handler functions.
+func (a *Authenticator) RequireUserFunc(next http.HandlerFunc) http.HandlerFunc {
+	return a.RequireUser(next).ServeHTTP
+}
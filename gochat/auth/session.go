@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	sessionName        = "cookie-name"
+	authenticatedField = "authenticated"
+	usernameField      = "username"
+)
+
+// ErrUnauthenticated is returned when a request does not carry a valid identity.
+var ErrUnauthenticated = errors.New("authentication required")
+
+// parseAllowedOrigins returns the set of origins, besides the server's own, that browsers may
+// connect from. A "*" entry allows every origin.
+func parseAllowedOrigins(origins []string) map[string]bool {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[strings.ToLower(origin)] = true
+		}
+	}
+	return allowed
+}
+
+// AllowedOrigin reports whether origin is one of the configured allowed origins.
+func (a *Authenticator) AllowedOrigin(origin string) bool {
+	return a.allowedOrigins["*"] || a.allowedOrigins[strings.ToLower(origin)]
+}
+
+// CheckOrigin reports whether a request comes from an allowed origin. Requests without an
+// Origin header, which browsers always send on websocket upgrades, are not cross-origin and are
+// allowed. It is used by the websocket upgraders since session cookies would otherwise let any
+// site open sockets on behalf of a logged in user.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.AllowedOrigin(origin) {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// SessionUsername returns the username of the authenticated session attached to r.
+func (a *Authenticator) SessionUsername(r *http.Request) (string, error) {
+	session, err := a.cookieStore.Get(r, sessionName)
+	if err != nil {
+		return "", ErrUnauthenticated
+	}
+
+	if auth, ok := session.Values[authenticatedField].(bool); !ok || !auth {
+		return "", ErrUnauthenticated
+	}
+	username, ok := session.Values[usernameField].(string)
+	if !ok || username == "" {
+		return "", ErrUnauthenticated
+	}
+
+	return username, nil
+}
+
+// RequestUsername returns the identity of the user making the request. It comes from the bearer
+// access token, the session cookie, or from the username form value in insecure dev mode. A request with an Authorization header is rejected if its token is not valid, rather
+// than falling back to the other methods.
+func (a *Authenticator) RequestUsername(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return a.BearerUsername(r)
+	}
+
+	username, err := a.SessionUsername(r)
+	if err == nil {
+		return username, nil
+	}
+
+	if a.insecureDevMode {
+		if username := r.FormValue("username"); username != "" {
+			return username, nil
+		}
+	}
+
+	return "", err
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stefan-chivu/gochat/gochat/configuration"
+)
+
+const (
+	tokenIssuer = "gochat"
+	// minTokenKeyLength is the shortest HMAC key accepted for HS256.
+	minTokenKeyLength = 32
+
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+// tokenClaims are the claims of access and refresh tokens. Type tells them apart so a refresh
+// token cannot be used as an access token and the other way around.
+type tokenClaims struct {
+	Type string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+// tokenResponse is the body returned by the token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// setupTokens sets up the keys and lifetimes of the tokens issued to non-browser clients.
+func (a *Authenticator) setupTokens(config *configuration.ServerConfig) error {
+	if config.AccessTokenTTL <= 0 || config.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("access and refresh token lifetimes must be positive")
+	}
+
+	keys, err := parseTokenKeys(config.TokenKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		config.Log.Warn().Msg("No token keys configured; using a random key, tokens will not survive restarts")
+		key := make([]byte, 64)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		keys = [][]byte{key}
+	}
+
+	a.tokenKeys = keys
+	a.accessTokenTTL = config.AccessTokenTTL
+	a.refreshTokenTTL = config.RefreshTokenTTL
+
+	return nil
+}
+
+func parseTokenKeys(entries []string) ([][]byte, error) {
+	var keys [][]byte
+
+	for i, entry := range entries {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("token key %d: invalid encoding: %v", i, err)
+		}
+		if len(key) < minTokenKeyLength {
+			return nil, fmt.Errorf("token key %d: must be at least %d bytes, got %d", i, minTokenKeyLength, len(key))
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// issueToken signs a token of the given type for username.
+func (a *Authenticator) issueToken(username string, tokenType string, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &tokenClaims{
+		Type: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Issuer:    tokenIssuer,
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.tokenKeys[0])
+}
+
+// issueTokens writes a new access and refresh token pair for username.
+func (a *Authenticator) issueTokens(w http.ResponseWriter, username string) {
+	access, err := a.issueToken(username, accessTokenType, a.accessTokenTTL)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	refresh, err := a.issueToken(username, refreshTokenType, a.refreshTokenTTL)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	responseData, err := json.Marshal(&tokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(a.accessTokenTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int(a.refreshTokenTTL.Seconds()),
+	})
+	if err != nil {
+		http.Error(w, "Token JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(responseData)
+}
+
+// parseToken verifies the signature, expiry and type of a token and returns its claims.
+func (a *Authenticator) parseToken(raw string, tokenType string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		keySet := jwt.VerificationKeySet{}
+		for _, key := range a.tokenKeys {
+			keySet.Keys = append(keySet.Keys, key)
+		}
+		return keySet, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Type != tokenType || claims.Subject == "" || claims.ID == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	return claims, nil
+}
+
+// useRefreshToken verifies a refresh token and revokes it so it cannot be used again.
+func (a *Authenticator) useRefreshToken(raw string) (*tokenClaims, error) {
+	claims, err := a.parseToken(raw, refreshTokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	used, err := a.revoked.IsRevoked(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, ErrUnauthenticated
+	}
+	if err := a.revoked.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// BearerUsername returns the username of the access token in the Authorization header of r.
+func (a *Authenticator) BearerUsername(r *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", ErrUnauthenticated
+	}
+
+	claims, err := a.parseToken(strings.TrimSpace(token), accessTokenType)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Subject, nil
+}
+
+// Token issues access and refresh tokens to non-browser clients. The password grant exchanges a
+// username and password for a token pair; the refresh_token grant exchanges a refresh token for a
+// new pair and revokes the old refresh token.
+func (a *Authenticator) Token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Form.Get("grant_type") {
+	case "password":
+		user, err := a.authenticateUser(r.Form.Get("username"), r.Form.Get("password"))
+		if err == ErrInvalidCredentials {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Login failed", http.StatusInternalServerError)
+			return
+		}
+		a.issueTokens(w, user.Username)
+	case "refresh_token":
+		claims, err := a.useRefreshToken(r.Form.Get("refresh_token"))
+		if err == ErrUnauthenticated {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Refresh failed", http.StatusInternalServerError)
+			return
+		}
+		a.issueTokens(w, claims.Subject)
+	default:
+		http.Error(w, "Unsupported grant type", http.StatusBadRequest)
+	}
+}
+
+// Revoke revokes a refresh token, which is how non-browser clients log out. Access tokens are
+// short lived and expire on their own.
+func (a *Authenticator) Revoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := a.parseToken(r.Form.Get("token"), refreshTokenType)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		return
+	}
+	if err := a.revoked.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
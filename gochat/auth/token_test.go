@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stefan-chivu/gochat/gochat/configuration"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+const (
+	testUsername = "alice"
+	testPassword = "correct horse battery"
+)
+
+// testConfig returns the configuration of the authenticators under test.
+func testConfig() *configuration.ServerConfig {
+	config := configuration.NewDefaultServerConfig()
+	config.Log = zerolog.Nop()
+	config.SessionMaxAge = time.Hour
+	config.AccessTokenTTL = time.Minute
+	config.RefreshTokenTTL = time.Hour
+	return config
+}
+
+// newTestAuthenticator returns an authenticator backed by a memory store with a registered test
+// user.
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+
+	a := newAuthenticator(t, testConfig(), store.NewMemoryStore())
+	if _, err := a.RegisterUser(testUsername, testPassword); err != nil {
+		t.Fatalf("registering %s: %v", testUsername, err)
+	}
+	return a
+}
+
+// newAuthenticator returns an authenticator configured by config and backed by db.
+func newAuthenticator(t *testing.T, config *configuration.ServerConfig, db store.Store) *Authenticator {
+	t.Helper()
+
+	a, err := NewAuthenticator(config, db, db)
+	if err != nil {
+		t.Fatalf("creating authenticator: %v", err)
+	}
+	return a
+}
+
+// requestTokens posts form to the token endpoint and returns the answer status and tokens.
+func requestTokens(t *testing.T, a *Authenticator, form url.Values) (int, *tokenResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Token(w, req)
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+		t.Fatalf("decoding tokens: %v", err)
+	}
+	return w.Code, &tokens
+}
+
+func passwordGrant(t *testing.T, a *Authenticator) *tokenResponse {
+	t.Helper()
+
+	status, tokens := requestTokens(t, a, url.Values{
+		"grant_type": {"password"},
+		"username":   {testUsername},
+		"password":   {testPassword},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("password grant: got status %d, want %d", status, http.StatusOK)
+	}
+	return tokens
+}
+
+func refreshGrant(t *testing.T, a *Authenticator, refreshToken string) (int, *tokenResponse) {
+	t.Helper()
+
+	return requestTokens(t, a, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+}
+
+// TestRefreshTokenRotation checks that a refresh token is exchanged for a new pair and that the
+// new refresh token can be used in turn.
+func TestRefreshTokenRotation(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tokens := passwordGrant(t, a)
+
+	for i := 0; i < 3; i++ {
+		status, rotated := refreshGrant(t, a, tokens.RefreshToken)
+		if status != http.StatusOK {
+			t.Fatalf("refresh %d: got status %d, want %d", i, status, http.StatusOK)
+		}
+		if rotated.RefreshToken == tokens.RefreshToken || rotated.AccessToken == tokens.AccessToken {
+			t.Fatalf("refresh %d: the tokens were not rotated", i)
+		}
+		tokens = rotated
+	}
+}
+
+// TestRefreshTokenReuse checks that refresh tokens are rejected once used or revoked.
+func TestRefreshTokenReuse(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tokens := passwordGrant(t, a)
+
+	if status, _ := refreshGrant(t, a, tokens.RefreshToken); status != http.StatusOK {
+		t.Fatalf("first use: got status %d, want %d", status, http.StatusOK)
+	}
+	if status, _ := refreshGrant(t, a, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("reuse: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	revoked := passwordGrant(t, a)
+	req := httptest.NewRequest(http.MethodPost, "/auth/revoke", strings.NewReader(url.Values{"token": {revoked.RefreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Revoke(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoking: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if status, _ := refreshGrant(t, a, revoked.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// An access token is not a refresh token.
+	if status, _ := refreshGrant(t, a, tokens.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("access token as refresh token: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// TestRequireUserWithBearerToken checks which Authorization headers RequireUser accepts.
+func TestRequireUserWithBearerToken(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tokens := passwordGrant(t, a)
+
+	other := newTestAuthenticator(t)
+	foreign := passwordGrant(t, other)
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "access token", authorization: "Bearer " + tokens.AccessToken, want: http.StatusOK},
+		{name: "lower case scheme", authorization: "bearer " + tokens.AccessToken, want: http.StatusOK},
+		{name: "refresh token", authorization: "Bearer " + tokens.RefreshToken, want: http.StatusUnauthorized},
+		{name: "token of another server", authorization: "Bearer " + foreign.AccessToken, want: http.StatusUnauthorized},
+		{name: "tampered token", authorization: "Bearer " + tokens.AccessToken + "x", want: http.StatusUnauthorized},
+		{name: "basic scheme", authorization: "Basic YWxpY2U6c2VjcmV0", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var username string
+			handler := a.RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, ok := ContextUser(r.Context()); ok {
+					username = user.Username
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/rooms", nil)
+			req.Header.Set("Authorization", tt.authorization)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && username != testUsername {
+				t.Errorf("got user %q in the request context, want %q", username, testUsername)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 answer without a WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// maxPasswordLength is the longest password bcrypt can hash without truncating it.
+	maxPasswordLength = 72
+)
+
+// ErrInvalidCredentials is returned when a login does not match a registered user.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// ValidateUsername checks the constraints on usernames chosen at registration.
+func ValidateUsername(username string) error {
+	if !validUsername.MatchString(username) {
+		return fmt.Errorf("username must be 3 to 32 letters, digits, '.', '_' or '-'")
+	}
+	return nil
+}
+
+// RegisterUser creates an account for username with a bcrypt hash of password.
+func (a *Authenticator) RegisterUser(username string, password string) (*models.User, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return nil, fmt.Errorf("password must be between %d and %d characters", minPasswordLength, maxPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user := &models.User{
+		Username:     username,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := a.users.CreateUser(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// authenticateUser returns the user registered as username if password matches.
+func (a *Authenticator) authenticateUser(username string, password string) (*models.User, error) {
+	user, err := a.users.User(username)
+	if err == store.ErrUserNotFound {
+		// Hash anyway so unknown usernames take as long to reject as wrong passwords.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// dummyHash is compared against when a login names an unknown user.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gochat-dummy-password"), bcrypt.DefaultCost)
@@ -25,13 +25,14 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
 // ServerConfig contains all of the configurables and tunables for various components of the gateway.
 // Many of these options may be set via command-line flags. See main.go for details on flags that
-// are available.
+// are available. In the configuration file, durations are strings such as "24h"; see Duration.
 type ServerConfig struct {
 	mu sync.RWMutex
 	// ClientTLSConfig are the gochat client TLS credentials. Setting this will enable client TLS.
@@ -57,6 +58,45 @@ type ServerConfig struct {
 	// ServerTLSCert is the path to the file containing the PEM-encoded x509 gochat server TLS key.
 	// See the gateway package for instructions for generating a self-signed certificate key.
 	ServerTLSKey string `json:"server_tls_key"`
+	// StorePath is the path of the database file where rooms, message history and user accounts are
+	// persisted. Everything is only kept in memory if the parameter is empty.
+	StorePath string `json:"store_path"`
+	// InsecureDevMode lets clients choose their identity with the username query parameter instead of
+	// logging in. Never enable it outside of local development.
+	InsecureDevMode bool `json:"insecure_dev_mode"`
+	// AllowedOrigins are the browser origins, besides the server's own, allowed to make credentialed
+	// requests and open websockets. A "*" entry allows every origin.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// SessionKeys are the keys used to protect session cookies. Each entry is a base64 encoded hash
+	// key of 32 or 64 bytes, optionally followed by ':' and a base64 encoded encryption key of 16,
+	// 24 or 32 bytes. The first entry protects new cookies; the others are only used to read existing
+	// cookies, which allows rotating keys without logging everybody out. Random keys are generated
+	// at startup if none are set, so sessions do not survive restarts.
+	SessionKeys []string `json:"session_keys"`
+	// SessionMaxAge is how long session cookies are valid.
+	SessionMaxAge time.Duration `json:"session_max_age"`
+	// SessionSecure only sends session cookies over HTTPS. Enable it whenever the server is behind TLS.
+	SessionSecure bool `json:"session_secure"`
+	// SessionSameSite is the SameSite attribute of session cookies: "lax", "strict" or "none".
+	// "none" requires SessionSecure.
+	SessionSameSite string `json:"session_same_site"`
+	// TokenKeys are the base64 encoded HMAC keys of at least 32 bytes used to sign the access and
+	// refresh tokens of non-browser clients. The first entry signs new tokens; all of them are
+	// accepted when verifying, which allows rotating keys. A random key is generated at startup if
+	// none are set, so tokens do not survive restarts.
+	TokenKeys []string `json:"token_keys"`
+	// AccessTokenTTL is how long access tokens are valid.
+	AccessTokenTTL time.Duration `json:"access_token_ttl"`
+	// RefreshTokenTTL is how long refresh tokens are valid. Each refresh token can only be used once.
+	RefreshTokenTTL time.Duration `json:"refresh_token_ttl"`
+	// SlowClientPolicy decides what happens when a room client cannot keep up with incoming messages:
+	// "drop-oldest" discards its oldest queued message, "disconnect" closes its connection and "block"
+	// holds its messages for up to SlowClientTimeout for the client to catch up before disconnecting it.
+	SlowClientPolicy string `json:"slow_client_policy"`
+	// SlowClientTimeout is how long a slow client has to catch up with the "block" policy.
+	SlowClientTimeout time.Duration `json:"slow_client_timeout"`
+	// AwayAfter is how long connected users can stay idle before they are shown as away.
+	AwayAfter time.Duration `json:"away_after"`
 }
 
 func NewDefaultServerConfig() *ServerConfig {
@@ -82,11 +122,54 @@ func PopulateServerConfigFromFile(config *ServerConfig, filePath string) error {
 		return fmt.Errorf("failed to read file at '%s': %v", path, err)
 	}
 
+	// The durations are read as strings such as "24h"; the other fields are decoded as they are.
+	type plainConfig ServerConfig
+	file := struct {
+		*plainConfig
+		SessionMaxAge     *Duration `json:"session_max_age"`
+		AccessTokenTTL    *Duration `json:"access_token_ttl"`
+		RefreshTokenTTL   *Duration `json:"refresh_token_ttl"`
+		SlowClientTimeout *Duration `json:"slow_client_timeout"`
+		AwayAfter         *Duration `json:"away_after"`
+	}{
+		plainConfig:       (*plainConfig)(config),
+		SessionMaxAge:     (*Duration)(&config.SessionMaxAge),
+		AccessTokenTTL:    (*Duration)(&config.AccessTokenTTL),
+		RefreshTokenTTL:   (*Duration)(&config.RefreshTokenTTL),
+		SlowClientTimeout: (*Duration)(&config.SlowClientTimeout),
+		AwayAfter:         (*Duration)(&config.AwayAfter),
+	}
+
 	decoder := json.NewDecoder(bytes.NewReader(data))
 	decoder.DisallowUnknownFields()
-	if err := decoder.Decode(config); err != nil {
+	if err := decoder.Decode(&file); err != nil {
 		return fmt.Errorf("failed to parse config file: %v", err)
 	}
 
 	return nil
 }
+
+// Duration is a duration in the configuration file. It is written as a string accepted by
+// time.ParseDuration, such as "24h" or "15m". Plain numbers are read as nanoseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	case float64:
+		*d = Duration(value)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
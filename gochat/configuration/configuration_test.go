@@ -0,0 +1,80 @@
+package configuration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a configuration file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDurationsFromFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"session_max_age": "24h",
+		"access_token_ttl": "15m",
+		"refresh_token_ttl": "720h",
+		"slow_client_timeout": 1500000000,
+		"away_after": "2m30s",
+		"slow_client_policy": "block"
+	}`)
+
+	config, err := NewServerConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tt := range map[string]struct{ got, want time.Duration }{
+		"session_max_age":     {config.SessionMaxAge, 24 * time.Hour},
+		"access_token_ttl":    {config.AccessTokenTTL, 15 * time.Minute},
+		"refresh_token_ttl":   {config.RefreshTokenTTL, 720 * time.Hour},
+		"slow_client_timeout": {config.SlowClientTimeout, 1500 * time.Millisecond},
+		"away_after":          {config.AwayAfter, 150 * time.Second},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", name, tt.got, tt.want)
+		}
+	}
+	if config.SlowClientPolicy != "block" {
+		t.Errorf("got slow client policy %q, want %q", config.SlowClientPolicy, "block")
+	}
+}
+
+func TestFileOverridesOnlyItsFields(t *testing.T) {
+	config := NewDefaultServerConfig()
+	config.SessionMaxAge = time.Hour
+	config.AwayAfter = time.Minute
+
+	if err := PopulateServerConfigFromFile(config, writeConfig(t, `{"away_after": "5m"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if config.SessionMaxAge != time.Hour {
+		t.Errorf("got session max age %v, want the %v set before", config.SessionMaxAge, time.Hour)
+	}
+	if config.AwayAfter != 5*time.Minute {
+		t.Errorf("got away after %v, want %v", config.AwayAfter, 5*time.Minute)
+	}
+}
+
+func TestInvalidConfigFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown duration unit":  `{"session_max_age": "3 days"}`,
+		"duration of wrong type": `{"session_max_age": true}`,
+		"unknown field":          `{"session_max_ages": "24h"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewServerConfigFromFile(writeConfig(t, content)); err == nil {
+				t.Error("the file was accepted")
+			}
+		})
+	}
+}
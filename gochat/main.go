@@ -7,11 +7,14 @@ import (
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/stefan-chivu/gochat/gochat/configuration"
 	server "github.com/stefan-chivu/gochat/gochat/server"
+	"github.com/stefan-chivu/gochat/gochat/store"
 )
 
 func main() {
@@ -51,9 +54,21 @@ func main() {
 		}
 	}
 
+	db, err := OpenStore(config)
+	if err != nil {
+		config.Log.Error().Err(err).Msgf("Unable to open store: %v", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	deferred = append(deferred, func() { db.Close() })
+
 	opts := new(server.StartOpts)
 
-	server := server.NewServer(config)
+	server, err := server.NewServer(config, db)
+	if err != nil {
+		config.Log.Error().Msgf("Unable to create server: %v", err)
+		os.Exit(1)
+	}
 	err = server.StartServer(opts) // run forever (or until an error happens)
 	if err != nil {
 		config.Log.Error().Msgf("Gateway exited with an error: %v", err)
@@ -77,8 +92,26 @@ func ParseArgs(config *configuration.ServerConfig) error {
 	flag.StringVar(&config.ServerListenAddress, "ServerListenAddress", "0.0.0.0:8080", "The interface IP address and port the gochat server will listen on")
 	flag.StringVar(&config.ServerTLSCert, "ServerTLSCert", "", "File containing the gNMI server TLS certificate (required to enable the gNMI server)")
 	flag.StringVar(&config.ServerTLSKey, "ServerTLSKey", "", "File containing the gNMI server TLS key (required to enable the gNMI server)")
+	flag.StringVar(&config.StorePath, "StorePath", "gochat.db", "Path of the database file used to persist rooms, messages and users (kept in memory only if empty)")
+	flag.BoolVar(&config.InsecureDevMode, "InsecureDevMode", false, "Let clients pick their username with a query parameter instead of logging in (development only)")
+	flag.Func("AllowedOrigins", "Comma separated list of browser origins allowed to connect besides the server's own (default \"http://localhost:3000\")", func(value string) error {
+		config.AllowedOrigins = strings.Split(value, ",")
+		return nil
+	})
+	flag.DurationVar(&config.SessionMaxAge, "SessionMaxAge", 7*24*time.Hour, "How long session cookies are valid")
+	flag.BoolVar(&config.SessionSecure, "SessionSecure", false, "Only send session cookies over HTTPS")
+	flag.StringVar(&config.SessionSameSite, "SessionSameSite", "lax", "SameSite attribute of session cookies: lax, strict or none")
+	flag.DurationVar(&config.AccessTokenTTL, "AccessTokenTTL", 15*time.Minute, "How long access tokens issued by /auth/token are valid")
+	flag.DurationVar(&config.RefreshTokenTTL, "RefreshTokenTTL", 30*24*time.Hour, "How long refresh tokens issued by /auth/token are valid")
+	flag.StringVar(&config.SlowClientPolicy, "SlowClientPolicy", "drop-oldest", "What to do with room clients that cannot keep up: drop-oldest, disconnect or block")
+	flag.DurationVar(&config.SlowClientTimeout, "SlowClientTimeout", time.Second, "How long a slow room client has to catch up with the block policy")
+	flag.DurationVar(&config.AwayAfter, "AwayAfter", 5*time.Minute, "How long connected users can stay idle before they are shown as away")
 	flag.Parse()
 
+	if config.AllowedOrigins == nil {
+		config.AllowedOrigins = []string{"http://localhost:3000"}
+	}
+
 	if *configFile != "" {
 		err := configuration.PopulateServerConfigFromFile(config, *configFile)
 		if err != nil {
@@ -93,6 +126,16 @@ func ParseArgs(config *configuration.ServerConfig) error {
 	return nil
 }
 
+// OpenStore opens the store configured by -StorePath, falling back to an in-memory store when no
+// path is set.
+func OpenStore(config *configuration.ServerConfig) (store.Store, error) {
+	if config.StorePath == "" {
+		config.Log.Warn().Msg("No store path configured; messages and users will not survive restarts")
+		return store.NewMemoryStore(), nil
+	}
+	return store.NewBoltStore(config.StorePath)
+}
+
 // SetupDebugging optionally sets up debugging features including -LogCaller and -PProf.
 func SetupDebugging(config *configuration.ServerConfig) (func(), error) {
 	var deferFuncs []func()
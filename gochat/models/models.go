@@ -1,11 +1,163 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// TimestampLayout is the RFC 3339 layout, with millisecond precision, used to serialize message
+// timestamps.
+const TimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// legacyTimestampLayout is the minute precision layout used by messages stored before
+// timestamps were serialized as RFC 3339.
+const legacyTimestampLayout = "02/01/2006 15:04"
+
 type Message struct {
-	Username  string `json:"username"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
+	// ID identifies the message within its room. IDs are assigned by the room in increasing order.
+	ID       uint64 `json:"id"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	// Timestamp is the time the server accepted the message.
+	Timestamp time.Time `json:"timestamp"`
+	// Nonce is an optional value chosen by the sender and echoed back with the message, so the
+	// sender can match the broadcast to its local copy.
+	Nonce string `json:"nonce,omitempty"`
+	// EditedAt is the time of the last edit of the message, if it was ever edited.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Deleted marks a tombstone: the message was deleted and its content cleared.
+	Deleted bool `json:"deleted,omitempty"`
+	// ParentID is the ID of the message this one replies to, if it is part of a thread.
+	ParentID uint64 `json:"parent_id,omitempty"`
+	// ReplyCount is the number of replies in the thread started by this message.
+	ReplyCount int `json:"reply_count,omitempty"`
+	// Reactions maps each emoji reacted to the message to the users who reacted with it.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// messageJSON is the wire representation of a Message.
+type messageJSON struct {
+	ID         uint64 `json:"id"`
+	Username   string `json:"username"`
+	Content    string `json:"content"`
+	Timestamp  string `json:"timestamp"`
+	Nonce      string `json:"nonce,omitempty"`
+	EditedAt   string `json:"edited_at,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	ParentID   uint64 `json:"parent_id,omitempty"`
+	ReplyCount int    `json:"reply_count,omitempty"`
+
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+func (m *Message) MarshalJSON() ([]byte, error) {
+	v := &messageJSON{
+		ID:         m.ID,
+		Username:   m.Username,
+		Content:    m.Content,
+		Timestamp:  m.Timestamp.UTC().Format(TimestampLayout),
+		Nonce:      m.Nonce,
+		Deleted:    m.Deleted,
+		ParentID:   m.ParentID,
+		ReplyCount: m.ReplyCount,
+		Reactions:  m.Reactions,
+	}
+	if m.EditedAt != nil {
+		v.EditedAt = m.EditedAt.UTC().Format(TimestampLayout)
+	}
+	return json.Marshal(v)
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var v messageJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, v.Timestamp)
+	if err != nil {
+		timestamp, err = time.Parse(legacyTimestampLayout, v.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	*m = Message{
+		ID:         v.ID,
+		Username:   v.Username,
+		Content:    v.Content,
+		Timestamp:  timestamp,
+		Nonce:      v.Nonce,
+		Deleted:    v.Deleted,
+		ParentID:   v.ParentID,
+		ReplyCount: v.ReplyCount,
+		Reactions:  v.Reactions,
+	}
+	if v.EditedAt != "" {
+		editedAt, err := time.Parse(time.RFC3339Nano, v.EditedAt)
+		if err != nil {
+			return err
+		}
+		m.EditedAt = &editedAt
+	}
+	return nil
 }
 
 type User struct {
-	Username string
+	Username string `json:"username"`
+	// PasswordHash is the bcrypt hash of the user's password. It must never be sent to clients.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// CreatedAt is the time the user registered.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Role is the role of a user in a room. It decides what the user may do in the room.
+type Role string
+
+const (
+	// RoleOwner is held by the creator of a room.
+	RoleOwner Role = "owner"
+	// RoleModerator is granted by the owner to help moderate a room.
+	RoleModerator Role = "moderator"
+	// RoleMember is held by every other user.
+	RoleMember Role = "member"
+)
+
+// Sanction is a ban or mute imposed on a user in a room. Sanctions are never changed once
+// created; lifting or extending one replaces it.
+type Sanction struct {
+	// By is the moderator who imposed the sanction.
+	By     string `json:"by"`
+	Reason string `json:"reason,omitempty"`
+	// At is the time the sanction was imposed.
+	At time.Time `json:"at"`
+	// Until is the time the sanction ends. Sanctions without an end are permanent.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Active reports whether the sanction is still in effect at now.
+func (s *Sanction) Active(now time.Time) bool {
+	return s.Until == nil || now.Before(*s.Until)
+}
+
+// Visibility decides who can see and join a room.
+type Visibility string
+
+const (
+	// VisibilityPublic rooms are listed to and can be joined by everybody.
+	VisibilityPublic Visibility = "public"
+	// VisibilityInvite rooms are only listed to and can only be joined by their members. Users
+	// become members by redeeming an invite.
+	VisibilityInvite Visibility = "invite"
+	// VisibilityPassword rooms are listed to everybody but can only be joined with the room's
+	// password or an invite.
+	VisibilityPassword Visibility = "password"
+)
+
+// Invite lets users join a room that is not public until it expires.
+type Invite struct {
+	Token string `json:"token"`
+	// CreatedBy is the user who created the invite.
+	CreatedBy string    `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -0,0 +1,224 @@
+// Package presence tracks which users are online across every connection they have to the
+// server: the lobby websocket and any number of room websockets, possibly from several tabs.
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the availability of a user.
+type Status string
+
+const (
+	// Online users have at least one connection and were active recently.
+	Online Status = "online"
+	// Away users are connected but have been idle for longer than the tracker's away delay.
+	Away Status = "away"
+	// Offline users have no connection.
+	Offline Status = "offline"
+)
+
+// Presence describes the availability of a user.
+type Presence struct {
+	Username string `json:"username"`
+	Status   Status `json:"status"`
+	// LastSeen is when the user was last active, or when they disconnected if they are offline.
+	LastSeen time.Time `json:"last_seen"`
+	// Connections is the number of sockets the user has open.
+	Connections int `json:"connections"`
+	// Rooms are the rooms the user is connected to, sorted by name.
+	Rooms []string `json:"rooms"`
+}
+
+// user is the state of a user known to the tracker.
+type user struct {
+	// connections counts the sockets of the user by room name; the lobby is "".
+	connections map[string]int
+	lastSeen    time.Time
+	// status is the last status reported to the change handler.
+	status Status
+}
+
+// Tracker keeps the presence of every user seen since the server started. It is safe for
+// concurrent use. Call Stop to release it.
+type Tracker struct {
+	mu sync.Mutex
+
+	users     map[string]*user
+	awayAfter time.Duration
+	// onChange is called with the new presence of users whose status changed. It is called with mu
+	// held and must not block.
+	onChange func(p *Presence)
+
+	quit chan struct{}
+	stop sync.Once
+}
+
+// NewTracker creates a tracker that shows users as away after being idle for awayAfter. A zero
+// awayAfter never shows users as away.
+func NewTracker(awayAfter time.Duration) *Tracker {
+	t := &Tracker{
+		users:     make(map[string]*user),
+		awayAfter: awayAfter,
+		quit:      make(chan struct{}),
+	}
+	if awayAfter > 0 {
+		go t.run()
+	}
+
+	return t
+}
+
+// OnChange sets the function called when users go online, away or offline. It must not block.
+func (t *Tracker) OnChange(onChange func(p *Presence)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onChange = onChange
+}
+
+// Connect records a new connection of username to room, or to the lobby if room is empty.
+func (t *Tracker) Connect(username string, room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.users[username]
+	if !ok {
+		u = &user{connections: make(map[string]int), status: Offline}
+		t.users[username] = u
+	}
+	u.connections[room]++
+	u.lastSeen = time.Now().UTC()
+	t.update(username, u)
+}
+
+// Disconnect records that a connection of username to room, or to the lobby if room is empty,
+// was closed.
+func (t *Tracker) Disconnect(username string, room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.users[username]
+	if !ok || u.connections[room] == 0 {
+		return
+	}
+	u.connections[room]--
+	if u.connections[room] == 0 {
+		delete(u.connections, room)
+	}
+	if len(u.connections) == 0 {
+		u.lastSeen = time.Now().UTC()
+	}
+	t.update(username, u)
+}
+
+// Touch records activity of username, such as a message sent, bringing them back from away.
+func (t *Tracker) Touch(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.users[username]
+	if !ok || len(u.connections) == 0 {
+		return
+	}
+	u.lastSeen = time.Now().UTC()
+	t.update(username, u)
+}
+
+// Get returns the presence of username. Users never seen are offline.
+func (t *Tracker) Get(username string) *Presence {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.users[username]
+	if !ok {
+		return &Presence{Username: username, Status: Offline, Rooms: []string{}}
+	}
+	return t.presence(username, u)
+}
+
+// Connected returns the presence of every user with a connection, sorted by name. Each user is
+// listed once however many connections they have.
+func (t *Tracker) Connected() []*Presence {
+	t.mu.Lock()
+	users := []*Presence{}
+	for username, u := range t.users {
+		if len(u.connections) > 0 {
+			users = append(users, t.presence(username, u))
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Stop stops looking for idle users. It is safe to call more than once.
+func (t *Tracker) Stop() {
+	t.stop.Do(func() {
+		close(t.quit)
+	})
+}
+
+// run periodically reports the users who became idle.
+func (t *Tracker) run() {
+	ticker := time.NewTicker(t.awayAfter / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			for username, u := range t.users {
+				t.update(username, u)
+			}
+			t.mu.Unlock()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// status computes the status of u. The caller must hold t.mu.
+func (t *Tracker) status(u *user) Status {
+	switch {
+	case len(u.connections) == 0:
+		return Offline
+	case t.awayAfter > 0 && time.Since(u.lastSeen) > t.awayAfter:
+		return Away
+	}
+	return Online
+}
+
+// update reports the new status of u if it changed. The caller must hold t.mu.
+func (t *Tracker) update(username string, u *user) {
+	status := t.status(u)
+	if status == u.status {
+		return
+	}
+	u.status = status
+	if t.onChange != nil {
+		t.onChange(t.presence(username, u))
+	}
+}
+
+// presence describes u. The caller must hold t.mu.
+func (t *Tracker) presence(username string, u *user) *Presence {
+	p := &Presence{
+		Username: username,
+		Status:   t.status(u),
+		LastSeen: u.lastSeen,
+		Rooms:    []string{},
+	}
+	for room, count := range u.connections {
+		p.Connections += count
+		if room != "" {
+			p.Rooms = append(p.Rooms, room)
+		}
+	}
+	sort.Strings(p.Rooms)
+
+	return p
+}
@@ -0,0 +1,345 @@
+// Package protocol defines the JSON envelope exchanged over room and lobby websockets.
+//
+// Every frame, in both directions, is a single Envelope:
+//
+//	{"v": 1, "type": "chat", "id": "c-42", "room": "Global", "payload": {"content": "hi"}}
+//
+// The payload schema depends on the type. Clients may only send chat, edit, delete, reaction and
+// typing envelopes; the server answers every accepted chat, edit, delete and reaction envelope
+// with an ack and every rejected frame with an error envelope that references the offending id.
+//
+// Chat messages starting with a moderation command, such as "/kick bob", "/ban bob 1h spam",
+// "/unban bob", "/mute bob 10m" or "/unmute bob", are run instead of being posted and are answered
+// with an ack or an error. The resulting action is announced to the room with a system envelope.
+//
+// The lobby websocket, served on the root path, only pushes envelopes to clients: room_created,
+// room_deleted and room_occupancy for the rooms the user can see, and presence envelopes with the
+// online, away and offline statuses of users across all their connections. Lobby envelopes about
+// a room carry its name; the others have an empty room.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Version is the current envelope schema version.
+const Version = 1
+
+// MaxContentLength is the maximum length of a chat message, in characters.
+const MaxContentLength = 4096
+
+// maxIDLength is the maximum length of a client supplied envelope id.
+const maxIDLength = 64
+
+type Type string
+
+const (
+	// TypeChat carries a chat message. Inbound payload: ChatPayload; outbound: models.Message.
+	TypeChat Type = "chat"
+	// TypeTyping notifies the room that a user started or stopped typing. Payload: TypingPayload.
+	TypeTyping Type = "typing"
+	// TypeAck confirms that an inbound envelope was accepted. Payload: AckPayload.
+	TypeAck Type = "ack"
+	// TypeError reports a rejected inbound envelope. Payload: ErrorPayload.
+	TypeError Type = "error"
+	// TypePresence announces users joining or leaving the room. Payload: PresencePayload.
+	TypePresence Type = "presence"
+	// TypeSystem carries server notices, such as moderation actions. Payload: SystemPayload.
+	TypeSystem Type = "system"
+	// TypeEdit changes the content of one's own message. Inbound payload: EditPayload; outbound:
+	// the edited models.Message.
+	TypeEdit Type = "edit"
+	// TypeDelete deletes one's own message, or any message for moderators. Inbound payload:
+	// DeletePayload; outbound: the models.Message tombstone.
+	TypeDelete Type = "delete"
+	// TypeReaction adds or removes a reaction on a message. Payload: ReactionPayload.
+	TypeReaction Type = "reaction"
+	// TypeRole announces that a user was granted a role in the room. Payload: RolePayload.
+	TypeRole Type = "role"
+	// TypeRoomCreated announces a new room on the lobby. Payload: room.RoomInfo.
+	TypeRoomCreated Type = "room_created"
+	// TypeRoomDeleted announces on the lobby that a room was deleted. Payload: empty object.
+	TypeRoomDeleted Type = "room_deleted"
+	// TypeRoomOccupancy reports on the lobby that users joined or left a room. Payload:
+	// OccupancyPayload.
+	TypeRoomOccupancy Type = "room_occupancy"
+)
+
+// Error codes used in ErrorPayload.
+const (
+	ErrMalformed          = "malformed"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownType        = "unknown_type"
+	ErrWrongRoom          = "wrong_room"
+	ErrInvalidPayload     = "invalid_payload"
+	ErrNotFound           = "not_found"
+	ErrForbidden          = "forbidden"
+)
+
+// Envelope is the frame wrapping every message exchanged over a room websocket.
+type Envelope struct {
+	Version int    `json:"v"`
+	Type    Type   `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Room    string `json:"room"`
+	// Payload is the type specific body of the envelope.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ChatPayload struct {
+	Content string `json:"content"`
+	// Nonce is an optional sender chosen value echoed back in the ack and in the broadcast message.
+	// Resending a message with the same nonce does not create a duplicate.
+	Nonce string `json:"nonce,omitempty"`
+	// ParentID makes the message a reply in the thread of the given top-level message.
+	ParentID uint64 `json:"parent_id,omitempty"`
+}
+
+type EditPayload struct {
+	MessageID uint64 `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+type DeletePayload struct {
+	MessageID uint64 `json:"message_id"`
+}
+
+// MaxEmojiLength is the maximum length of a reaction, in bytes.
+const MaxEmojiLength = 32
+
+type ReactionPayload struct {
+	MessageID uint64 `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	// Remove withdraws the reaction instead of adding it.
+	Remove bool `json:"remove,omitempty"`
+	// Username is the user who reacted. It is set by the server on outbound events.
+	Username string `json:"username,omitempty"`
+}
+
+type TypingPayload struct {
+	Username string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+
+type AckPayload struct {
+	// MessageID is the ID of the message the acknowledged envelope created or changed.
+	MessageID uint64 `json:"message_id,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+	// PresenceOnline, PresenceAway and PresenceOffline are sent on the lobby.
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+type PresencePayload struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	// LastSeen is when the user was last active. It is only set on lobby events.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type RolePayload struct {
+	Username string `json:"username"`
+	// Role is "owner", "moderator" or "member".
+	Role string `json:"role"`
+}
+
+type OccupancyPayload struct {
+	// ClientCount is the number of connections to the room.
+	ClientCount int `json:"client_count"`
+}
+
+type SystemPayload struct {
+	Content string `json:"content"`
+}
+
+// Error is returned when an inbound frame is rejected. It carries the id of the offending
+// envelope, when one could be read, so the error envelope can reference it.
+type Error struct {
+	Code    string
+	Message string
+	Ref     string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Encode builds the JSON frame of an envelope of type t carrying payload.
+func Encode(t Type, room string, id string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %v", t, err)
+	}
+
+	return json.Marshal(&Envelope{
+		Version: Version,
+		Type:    t,
+		ID:      id,
+		Room:    room,
+		Payload: data,
+	})
+}
+
+// EncodeError builds the error envelope answering a rejected frame.
+func EncodeError(room string, e *Error) ([]byte, error) {
+	return Encode(TypeError, room, e.Ref, &ErrorPayload{Code: e.Code, Message: e.Message})
+}
+
+// Decode parses and validates an inbound frame sent by a client connected to room.
+func Decode(data []byte, room string) (*Envelope, error) {
+	var env Envelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&env); err != nil {
+		return nil, &Error{Code: ErrMalformed, Message: "frame is not a valid envelope"}
+	}
+
+	if len(env.ID) > maxIDLength {
+		return nil, &Error{Code: ErrMalformed, Message: fmt.Sprintf("id must not exceed %d characters", maxIDLength)}
+	}
+	if env.Version != Version {
+		return nil, &Error{Code: ErrUnsupportedVersion, Message: fmt.Sprintf("supported version is %d", Version), Ref: env.ID}
+	}
+	if env.Room != room {
+		return nil, &Error{Code: ErrWrongRoom, Message: "envelope room does not match the connection", Ref: env.ID}
+	}
+
+	var err error
+	switch env.Type {
+	case TypeChat:
+		var p ChatPayload
+		if err = decodePayload(env.Payload, &p); err == nil {
+			err = ValidateContent(p.Content)
+		}
+		if err == nil && len(p.Nonce) > maxIDLength {
+			err = fmt.Errorf("nonce must not exceed %d characters", maxIDLength)
+		}
+	case TypeEdit:
+		var p EditPayload
+		if err = decodePayload(env.Payload, &p); err == nil {
+			err = validateMessageID(p.MessageID)
+		}
+		if err == nil {
+			err = ValidateContent(p.Content)
+		}
+	case TypeDelete:
+		var p DeletePayload
+		if err = decodePayload(env.Payload, &p); err == nil {
+			err = validateMessageID(p.MessageID)
+		}
+	case TypeReaction:
+		var p ReactionPayload
+		if err = decodePayload(env.Payload, &p); err == nil {
+			err = validateMessageID(p.MessageID)
+		}
+		if err == nil {
+			err = ValidateEmoji(p.Emoji)
+		}
+	case TypeTyping:
+		var p TypingPayload
+		err = decodePayload(env.Payload, &p)
+	default:
+		return nil, &Error{Code: ErrUnknownType, Message: fmt.Sprintf("clients cannot send '%s' envelopes", env.Type), Ref: env.ID}
+	}
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidPayload, Message: err.Error(), Ref: env.ID}
+	}
+
+	return &env, nil
+}
+
+// Chat returns the payload of a validated chat envelope.
+func (e *Envelope) Chat() *ChatPayload {
+	var p ChatPayload
+	json.Unmarshal(e.Payload, &p)
+	return &p
+}
+
+// Edit returns the payload of a validated edit envelope.
+func (e *Envelope) Edit() *EditPayload {
+	var p EditPayload
+	json.Unmarshal(e.Payload, &p)
+	return &p
+}
+
+// Delete returns the payload of a validated delete envelope.
+func (e *Envelope) Delete() *DeletePayload {
+	var p DeletePayload
+	json.Unmarshal(e.Payload, &p)
+	return &p
+}
+
+// Reaction returns the payload of a validated reaction envelope.
+func (e *Envelope) Reaction() *ReactionPayload {
+	var p ReactionPayload
+	json.Unmarshal(e.Payload, &p)
+	return &p
+}
+
+// Typing returns the payload of a validated typing envelope.
+func (e *Envelope) Typing() *TypingPayload {
+	var p TypingPayload
+	json.Unmarshal(e.Payload, &p)
+	return &p
+}
+
+func decodePayload(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("missing payload")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("malformed payload")
+	}
+	return nil
+}
+
+// ValidateContent checks that content can be used as the content of a chat message.
+func ValidateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("content cannot be empty")
+	}
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return fmt.Errorf("content should not exceed %d characters", MaxContentLength)
+	}
+	return nil
+}
+
+// ValidateEmoji checks that emoji can be used as a reaction.
+func ValidateEmoji(emoji string) error {
+	if emoji == "" {
+		return fmt.Errorf("emoji cannot be empty")
+	}
+	if len(emoji) > MaxEmojiLength {
+		return fmt.Errorf("emoji should not exceed %d bytes", MaxEmojiLength)
+	}
+	if strings.IndexFunc(emoji, unicode.IsSpace) >= 0 || !utf8.ValidString(emoji) {
+		return fmt.Errorf("emoji is not valid")
+	}
+	return nil
+}
+
+func validateMessageID(id uint64) error {
+	if id == 0 {
+		return fmt.Errorf("message_id is required")
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package room
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// privateChatPrefix starts the names of the private chats created before direct
+	// conversations replaced them.
+	privateChatPrefix = "Private_"
+
+	minRoomPasswordLength = 4
+	// maxRoomPasswordLength is the longest password bcrypt can hash without truncating it.
+	maxRoomPasswordLength = 72
+
+	// DefaultInviteTTL is how long invites are valid unless another lifetime is requested.
+	DefaultInviteTTL = 24 * time.Hour
+	// MaxInviteTTL is the longest lifetime of an invite.
+	MaxInviteTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNotInvited        = errors.New("this room is invite-only")
+	ErrWrongPassword     = errors.New("wrong room password")
+	ErrInvalidVisibility = errors.New("visibility must be 'public', 'invite' or 'password'")
+	ErrInvalidPassword   = fmt.Errorf("room password must be between %d and %d characters", minRoomPasswordLength, maxRoomPasswordLength)
+	ErrInviteNotFound    = errors.New("invite not found")
+	// ErrConversationAccess is returned when inviting to or joining a direct or group conversation,
+	// whose participants are only ever added through AddParticipant.
+	ErrConversationAccess = errors.New("conversations can only be joined by being added as a participant")
+)
+
+// ParseVisibility reads a room visibility. An empty value is public.
+func ParseVisibility(value string) (models.Visibility, error) {
+	switch v := models.Visibility(strings.ToLower(value)); v {
+	case "":
+		return models.VisibilityPublic, nil
+	case models.VisibilityPublic, models.VisibilityInvite, models.VisibilityPassword:
+		return v, nil
+	}
+	return "", ErrInvalidVisibility
+}
+
+// SetVisibility changes who can see and join the room. Password protected rooms require a
+// password; it is ignored otherwise. It does not check permissions and is meant to be called when
+// the room is created, before it is saved.
+func (r *Room) SetVisibility(visibility models.Visibility, password string) error {
+	var hash []byte
+	switch visibility {
+	case models.VisibilityPublic, models.VisibilityInvite:
+	case models.VisibilityPassword:
+		if len(password) < minRoomPasswordLength || len(password) > maxRoomPasswordLength {
+			return ErrInvalidPassword
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("failed to hash room password: %v", err)
+		}
+	default:
+		return ErrInvalidVisibility
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.visibility = visibility
+	r.passwordHash = string(hash)
+	return nil
+}
+
+// Visibility returns who can see and join the room.
+func (r *Room) Visibility() models.Visibility {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.visibility
+}
+
+// IsMember reports whether username may read and join the room without a password or invite.
+// Everybody is a member of public rooms.
+func (r *Room) IsMember(username string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.isMemberLocked(username)
+}
+
+// isMemberLocked is IsMember for callers holding r.mu.
+func (r *Room) isMemberLocked(username string) bool {
+	return r.visibility == models.VisibilityPublic || r.members[username] ||
+		r.roleLocked(username) != models.RoleMember
+}
+
+// HistoryFrom returns the ID of the last message username cannot read, or zero if they can read
+// the whole history.
+func (r *Room) HistoryFrom(username string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.historyFrom[username]
+}
+
+// lastMessage returns the newest message of the room username can read, if any.
+func (r *Room) lastMessage(username string) *models.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.Messages) == 0 {
+		return nil
+	}
+	if msg := r.Messages[len(r.Messages)-1]; msg.ID > r.historyFrom[username] {
+		return msg
+	}
+	return nil
+}
+
+// CanSee reports whether the room is listed to username. Invite-only rooms are hidden from users
+// who are not members.
+func (r *Room) CanSee(username string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.visibility != models.VisibilityInvite || r.isMemberLocked(username)
+}
+
+// Members returns the members of a room that is not public, sorted by name.
+func (r *Room) Members() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.memberList()
+}
+
+// memberList returns the sorted members. The caller must hold r.mu.
+func (r *Room) memberList() []string {
+	members := make([]string, 0, len(r.members))
+	for username := range r.members {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// AddMember lets username join the room without a password or invite. It does not check
+// permissions and is meant to be called when the room is created, before it is saved.
+func (r *Room) AddMember(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.members[username] = true
+}
+
+// Join checks that username may join the room, with the room's password or an invite token if
+// they are not a member yet. Users admitted with a password or invite become members.
+func (r *Room) Join(username string, password string, invite string) error {
+	if r.IsMember(username) {
+		return nil
+	}
+	if r.isConversation() {
+		return ErrConversationAccess
+	}
+
+	r.mu.Lock()
+	visibility, hash := r.visibility, r.passwordHash
+	invited := r.validInvite(invite)
+	r.mu.Unlock()
+
+	if !invited {
+		if visibility != models.VisibilityPassword {
+			return ErrNotInvited
+		}
+		if password == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return ErrWrongPassword
+		}
+	}
+
+	var err error
+	ok := r.exec(func() {
+		err = r.updateRecord(func() func() {
+			r.members[username] = true
+			return func() { delete(r.members, username) }
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting membership of %s: %v", r.Name, username, err)
+		}
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// isConversation reports whether the room is a direct or group conversation.
+func (r *Room) isConversation() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.direct || r.group
+}
+
+// validInvite reports whether token is an unexpired invite to the room. The caller must hold r.mu.
+func (r *Room) validInvite(token string) bool {
+	if token == "" {
+		return false
+	}
+	invite, ok := r.invites[token]
+	return ok && time.Now().Before(invite.ExpiresAt)
+}
+
+// CreateInvite creates an invite to the room valid for ttl on behalf of actor, who must be allowed
+// to invite users.
+func (r *Room) CreateInvite(actor string, ttl time.Duration) (*models.Invite, error) {
+	if ttl <= 0 || ttl > MaxInviteTTL {
+		return nil, ErrInvalidDuration
+	}
+	if !r.Can(actor, PermInvite) {
+		return nil, ErrForbidden
+	}
+	if r.isConversation() {
+		return nil, ErrConversationAccess
+	}
+
+	token := make([]byte, 18)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	invite := &models.Invite{
+		Token:     base64.RawURLEncoding.EncodeToString(token),
+		CreatedBy: actor,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+
+	var err error
+	ok := r.exec(func() {
+		err = r.updateRecord(func() func() {
+			r.invites[invite.Token] = invite
+			return func() { delete(r.invites, invite.Token) }
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting invite: %v", r.Name, err)
+		}
+	})
+	if !ok {
+		return nil, ErrRoomStopped
+	}
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// RevokeInvite deletes an invite to the room on behalf of actor.
+func (r *Room) RevokeInvite(actor string, token string) error {
+	if !r.Can(actor, PermInvite) {
+		return ErrForbidden
+	}
+
+	var err error
+	ok := r.exec(func() {
+		r.mu.Lock()
+		invite, found := r.invites[token]
+		r.mu.Unlock()
+		if !found {
+			err = ErrInviteNotFound
+			return
+		}
+
+		err = r.updateRecord(func() func() {
+			delete(r.invites, token)
+			return func() { r.invites[token] = invite }
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting invite revocation: %v", r.Name, err)
+		}
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// Invites returns the unexpired invites to the room, oldest first.
+func (r *Room) Invites() []*models.Invite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.activeInvites()
+}
+
+// activeInvites returns the unexpired invites, oldest first. The caller must hold r.mu.
+func (r *Room) activeInvites() []*models.Invite {
+	invites := []*models.Invite{}
+	now := time.Now()
+	for _, invite := range r.invites {
+		if now.Before(invite.ExpiresAt) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].ExpiresAt.Before(invites[j].ExpiresAt) })
+	return invites
+}
+
+// restoreAccess loads the visibility, members and invites of a stored room record. Private chats
+// stored before visibility was introduced become invite-only rooms of the two users named in
+// their name; the split is a best guess when the first username contains an underscore.
+func (r *Room) restoreAccess(record *store.RoomRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.visibility = record.Visibility
+	r.passwordHash = record.PasswordHash
+	for _, username := range record.Members {
+		r.members[username] = true
+	}
+	for _, invite := range record.Invites {
+		r.invites[invite.Token] = invite
+	}
+	for username, id := range record.HistoryFrom {
+		r.historyFrom[username] = id
+	}
+
+	if r.visibility == "" {
+		r.visibility = models.VisibilityPublic
+		if users, ok := strings.CutPrefix(record.Name, privateChatPrefix); ok {
+			r.visibility = models.VisibilityInvite
+			username1, username2, _ := strings.Cut(users, "_")
+			r.members[username1] = true
+			r.members[username2] = true
+		}
+	}
+}
+
+// RequireMember only lets members of the room through to next. Other users get 403 Forbidden, so
+// the history and users of rooms that are not public stay hidden.
+func (r *Room) RequireMember(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user, ok := auth.ContextUser(req.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !r.IsMember(user.Username) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// HandleJoin serves /rooms/{name}/join. POST makes the user a member of the room with the
+// password or invite form value, so clients do not have to put them in the websocket URL.
+func (r *Room) HandleJoin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Ban(user.Username) != nil {
+		http.Error(w, fmt.Sprintf("You are banned from room '%s'", r.Name), http.StatusForbidden)
+		return
+	}
+
+	if err := r.Join(user.Username, req.Form.Get("password"), req.Form.Get("invite")); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleInvites serves /rooms/{name}/invites. GET lists the unexpired invites, POST creates one
+// valid for the optional ttl form value and DELETE revokes the one given by the token form value.
+// Only users allowed to invite may manage invites.
+func (r *Room) HandleInvites(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var response interface{}
+	status := http.StatusOK
+	switch req.Method {
+	case http.MethodGet:
+		if !r.Can(user.Username, PermInvite) {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		response = r.Invites()
+	case http.MethodPost:
+		ttl := DefaultInviteTTL
+		if value := req.Form.Get("ttl"); value != "" {
+			var err error
+			if ttl, err = time.ParseDuration(value); err != nil {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+		invite, err := r.CreateInvite(user.Username, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		status = http.StatusCreated
+		response = invite
+	case http.MethodDelete:
+		if err := r.RevokeInvite(user.Username, req.Form.Get("token")); err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Invites JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(responseData)
+}
@@ -0,0 +1,199 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait is the time allowed to write a single message to a client socket.
+const writeWait = 10 * time.Second
+
+// SendPolicy decides what happens when a client's outbound queue is full.
+type SendPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one.
+	DropOldest SendPolicy = iota
+	// Disconnect closes the connection of a client whose queue is full.
+	Disconnect
+	// BlockWithTimeout gives a client whose queue is full up to the room's SendTimeout to catch
+	// up, holding the messages sent meanwhile in an overflow queue, and disconnects it if it does
+	// not. The room never waits on the client.
+	BlockWithTimeout
+)
+
+func (p SendPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	case BlockWithTimeout:
+		return "block"
+	}
+	return fmt.Sprintf("SendPolicy(%d)", int(p))
+}
+
+// ParseSendPolicy converts the configuration name of a policy to a SendPolicy.
+func ParseSendPolicy(name string) (SendPolicy, error) {
+	for _, p := range []SendPolicy{DropOldest, Disconnect, BlockWithTimeout} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return DropOldest, fmt.Errorf("unknown slow client policy '%s'", name)
+}
+
+// client is a single websocket connection to a room. Every client owns a writer goroutine that
+// drains its send queue, so a slow socket only ever delays its own messages.
+type client struct {
+	conn     *websocket.Conn
+	username string
+
+	// send is the bounded queue of outbound messages.
+	send chan []byte
+	// done is closed when the client is shut down.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// mu guards overflow and stall, which are only used by the BlockWithTimeout policy.
+	mu sync.Mutex
+	// overflow holds the messages queued while send was full, oldest first. They are written
+	// after everything in send.
+	overflow [][]byte
+	// stall disconnects the client unless overflow is drained first.
+	stall *time.Timer
+}
+
+// deadline returns the deadline for writing a control frame.
+func deadline() time.Time {
+	return time.Now().Add(writeWait)
+}
+
+func newClient(conn *websocket.Conn, username string) *client {
+	return &client{
+		conn:     conn,
+		username: username,
+		send:     make(chan []byte, messageBufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue queues msg for delivery according to policy. It returns false if the client should be
+// disconnected because it cannot keep up.
+func (c *client) enqueue(msg []byte, policy SendPolicy, timeout time.Duration) bool {
+	if policy == BlockWithTimeout {
+		return c.enqueueWithDeadline(msg, timeout)
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.done:
+		return true
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		for {
+			select {
+			case c.send <- msg:
+				return true
+			case <-c.done:
+				return true
+			default:
+			}
+			select {
+			case <-c.send:
+			default:
+			}
+		}
+	}
+
+	return false
+}
+
+// enqueueWithDeadline queues msg without ever blocking. While send is full, messages go to the
+// overflow queue and the client has timeout to drain it before it is disconnected. It returns
+// false if the overflow queue is full too.
+func (c *client) enqueueWithDeadline(msg []byte, timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	if len(c.overflow) == 0 {
+		select {
+		case c.send <- msg:
+			return true
+		case <-c.done:
+			return true
+		default:
+		}
+		c.stall = time.AfterFunc(timeout, func() {
+			log.Default().Printf("%s did not catch up within %v; disconnecting", c.username, timeout)
+			c.close()
+		})
+	}
+	if len(c.overflow) >= messageBufferSize {
+		return false
+	}
+	c.overflow = append(c.overflow, msg)
+	return true
+}
+
+// nextOverflow takes the oldest overflow message once send is empty. When the overflow queue is
+// drained, the client is no longer at risk of being disconnected.
+func (c *client) nextOverflow() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.send) > 0 || len(c.overflow) == 0 {
+		return nil, false
+	}
+	msg := c.overflow[0]
+	c.overflow[0] = nil
+	c.overflow = c.overflow[1:]
+	if len(c.overflow) == 0 {
+		c.stall.Stop()
+		c.overflow = nil
+	}
+	return msg, true
+}
+
+func (c *client) writeLoop() {
+	for {
+		msg, ok := c.nextOverflow()
+		if !ok {
+			select {
+			case msg = <-c.send:
+			case <-c.done:
+				return
+			}
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Default().Println("Websocket write error: ", err)
+			c.close()
+			return
+		}
+	}
+}
+
+// close stops the writer goroutine and closes the underlying connection. It is safe to call
+// more than once.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,147 @@
+package room
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// floodMessages is enough messages to fill the send queue of a client that never reads and
+	// the socket buffers behind it.
+	floodMessages = 800
+	// floodMessageSize is the size of each flood message.
+	floodMessageSize = 64 * 1024
+	// deliveryBound is how long a message may take to reach a client that reads. It is well under
+	// the SendTimeout of the tests, so a broadcast waiting on a stuck client would exceed it.
+	deliveryBound = 500 * time.Millisecond
+)
+
+// TestStuckClientsDoNotDelayOthers floods a room in which two clients never read and checks that
+// every message still reaches the other clients promptly, whatever the send policy.
+func TestStuckClientsDoNotDelayOthers(t *testing.T) {
+	tests := []struct {
+		policy SendPolicy
+		// dropped tells whether the stuck clients are expected to be disconnected.
+		dropped bool
+	}{
+		{policy: DropOldest, dropped: false},
+		{policy: Disconnect, dropped: true},
+		{policy: BlockWithTimeout, dropped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			r := NewRoom("flood", 0, nil)
+			t.Cleanup(r.Stop)
+			r.SendPolicy = tt.policy
+			r.SendTimeout = 2 * time.Second
+
+			srv := newTestServer(t, r)
+			dial(t, srv, "stuck")
+			dial(t, srv, "frozen")
+			readers := []string{"alice", "bob"}
+			conns := make(map[string]chan string, len(readers))
+			for _, username := range readers {
+				received := make(chan string, 1)
+				conns[username] = received
+				conn := dial(t, srv, username)
+				go func() {
+					for {
+						_, data, err := conn.ReadMessage()
+						if err != nil {
+							close(received)
+							return
+						}
+						if prefix, _, ok := strings.Cut(string(data), ":"); ok && !strings.HasPrefix(prefix, "{") {
+							received <- prefix
+						}
+					}
+				}()
+			}
+			waitFor(t, 5*time.Second, "clients to join", func() bool { return r.ClientCount() == 4 })
+
+			padding := strings.Repeat("x", floodMessageSize)
+			for i := 0; i < floodMessages; i++ {
+				id := fmt.Sprint(i)
+				start := time.Now()
+				r.exec(func() { r.broadcast([]byte(id+":"+padding), nil) })
+				for _, username := range readers {
+					select {
+					case got, ok := <-conns[username]:
+						if !ok {
+							t.Fatalf("%s was disconnected at message %d", username, i)
+						}
+						if got != id {
+							t.Fatalf("%s got message %s, want %s", username, got, id)
+						}
+					case <-time.After(deliveryBound - time.Since(start)):
+						t.Fatalf("%s did not get message %d within %v", username, i, deliveryBound)
+					}
+				}
+			}
+
+			if tt.dropped {
+				waitFor(t, r.SendTimeout+5*time.Second, "the stuck clients to be dropped", func() bool { return r.ClientCount() == 2 })
+			} else if got := r.ClientCount(); got != 4 {
+				t.Errorf("got %d clients after the flood, want 4", got)
+			}
+		})
+	}
+}
+
+// TestBlockedClientsDoNotHoldHub checks that with BlockWithTimeout the hub keeps serving the room
+// while clients fall behind, and that they are disconnected once their SendTimeout has passed.
+func TestBlockedClientsDoNotHoldHub(t *testing.T) {
+	r := NewRoom("blocked", 0, nil)
+	t.Cleanup(r.Stop)
+	r.SendPolicy = BlockWithTimeout
+	r.SendTimeout = 2 * time.Second
+
+	srv := newTestServer(t, r)
+	dial(t, srv, "stuck")
+	dial(t, srv, "frozen")
+	waitFor(t, 5*time.Second, "clients to join", func() bool { return r.ClientCount() == 2 })
+
+	// Broadcast until both clients have messages waiting in their overflow queue.
+	padding := []byte(strings.Repeat("x", floodMessageSize))
+	for i := 0; !allOverflowing(r); i++ {
+		if i == floodMessages {
+			t.Fatal("the clients never fell behind")
+		}
+		start := time.Now()
+		r.exec(func() { r.broadcast(padding, nil) })
+		if elapsed := time.Since(start); elapsed > deliveryBound {
+			t.Fatalf("broadcast %d held the hub for %v", i, elapsed)
+		}
+	}
+
+	start := time.Now()
+	r.Info()
+	r.Users()
+	if elapsed := time.Since(start); elapsed > deliveryBound {
+		t.Errorf("reading the room took %v while clients were behind", elapsed)
+	}
+	if got := r.ClientCount(); got != 2 {
+		t.Fatalf("got %d clients before the SendTimeout, want 2", got)
+	}
+
+	waitFor(t, r.SendTimeout+5*time.Second, "the stuck clients to be dropped", func() bool { return r.ClientCount() == 0 })
+}
+
+// allOverflowing reports whether every client of r has messages in its overflow queue.
+func allOverflowing(r *Room) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.clients {
+		c.mu.Lock()
+		n := len(c.overflow)
+		c.mu.Unlock()
+		if n == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// DirectPrefix starts the names of the rooms backing direct conversations. Usernames cannot
+// contain ':', so names of different pairs never collide.
+const DirectPrefix = "dm:"
+
+var ErrSelfConversation = errors.New("cannot start a conversation with yourself")
+
+// DirectConversation is a private conversation between two users. It is backed by an invite-only
+// room whose members are the two participants, so it supports everything rooms do. Participants
+// may have any number of sockets open on the conversation; messages are delivered to all of them.
+type DirectConversation struct {
+	*Room
+
+	// Participants are the two users of the conversation, sorted by name.
+	Participants [2]string
+}
+
+// directParticipants returns the two users sorted by name.
+func directParticipants(username1 string, username2 string) [2]string {
+	participants := [2]string{username1, username2}
+	sort.Strings(participants[:])
+	return participants
+}
+
+// DirectName returns the name of the room of the conversation between two users. It does not
+// depend on the order of the users.
+func DirectName(username1 string, username2 string) string {
+	participants := directParticipants(username1, username2)
+	return DirectPrefix + participants[0] + ":" + participants[1]
+}
+
+// NewDirectConversation creates the conversation between two users and starts its room.
+func NewDirectConversation(username1 string, username2 string, messageStore store.MessageStore) (*DirectConversation, error) {
+	if username1 == username2 {
+		return nil, ErrSelfConversation
+	}
+
+	participants := directParticipants(username1, username2)
+	// Participants may keep several sockets open, so the number of connections is not limited.
+	r := NewRoom(DirectName(username1, username2), 0, messageStore)
+	r.direct = true
+	r.SetVisibility(models.VisibilityInvite, "")
+	r.AddMember(participants[0])
+	r.AddMember(participants[1])
+
+	return &DirectConversation{Room: r, Participants: participants}, nil
+}
+
+// RestoreDirectConversation recreates a conversation from its stored room record.
+func RestoreDirectConversation(record *store.RoomRecord, messageStore store.MessageStore) (*DirectConversation, error) {
+	users, ok := strings.CutPrefix(record.Name, DirectPrefix)
+	username1, username2, found := strings.Cut(users, ":")
+	if !ok || !found || !record.Direct {
+		return nil, fmt.Errorf("room '%s' is not a direct conversation", record.Name)
+	}
+
+	r, err := RestoreRoom(record, messageStore)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectConversation{Room: r, Participants: directParticipants(username1, username2)}, nil
+}
+
+// HasParticipant reports whether username takes part in the conversation.
+func (d *DirectConversation) HasParticipant(username string) bool {
+	return d.Participants[0] == username || d.Participants[1] == username
+}
+
+// Info returns the description of the conversation.
+func (d *DirectConversation) Info(username string) *ConversationInfo {
+	return &ConversationInfo{
+		Name:         d.Name,
+		Kind:         "direct",
+		Participants: []string{d.Participants[0], d.Participants[1]},
+		LastMessage:  d.lastMessage(username),
+	}
+}
@@ -0,0 +1,215 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotAuthor       = errors.New("only the author can change a message")
+	ErrMessageDeleted  = errors.New("message was deleted")
+	ErrRoomStopped     = errors.New("room is closed")
+)
+
+// EditMessage replaces the content of a message written by username and broadcasts the change.
+// Muted users cannot edit their messages, and nobody can in archived rooms.
+func (r *Room) EditMessage(username string, id uint64, content string) (*models.Message, error) {
+	if r.Mute(username) != nil {
+		return nil, ErrMuted
+	}
+	if r.Archived() {
+		return nil, ErrArchived
+	}
+	return r.changeMessage(username, id, false, protocol.TypeEdit, func(msg *models.Message) {
+		now := time.Now().UTC()
+		msg.Content = content
+		msg.EditedAt = &now
+	})
+}
+
+// DeleteMessage turns a message into a tombstone on behalf of username, who must be its author or
+// be allowed to delete other users' messages, and broadcasts the change. The tombstone keeps its
+// ID and position in history so replies and clients can still refer to it.
+func (r *Room) DeleteMessage(username string, id uint64) (*models.Message, error) {
+	moderate := r.Can(username, PermDeleteMessages)
+	return r.changeMessage(username, id, moderate, protocol.TypeDelete, func(msg *models.Message) {
+		msg.Content = ""
+		msg.Deleted = true
+	})
+}
+
+// changeMessage applies change to a copy of the message on the hub, stores it and broadcasts it
+// as an envelope of type t. Only the author may change the message unless moderate is set.
+// Messages are copied rather than changed in place because snapshots handed out by History may
+// still be in use.
+func (r *Room) changeMessage(username string, id uint64, moderate bool, t protocol.Type, change func(*models.Message)) (*models.Message, error) {
+	var changed *models.Message
+	var err error
+
+	ok := r.exec(func() {
+		r.mu.Lock()
+		i := r.messageIndex(id)
+		if i < 0 {
+			r.mu.Unlock()
+			err = ErrMessageNotFound
+			return
+		}
+		msg := *r.Messages[i]
+		r.mu.Unlock()
+
+		if msg.Username != username && !moderate {
+			err = ErrNotAuthor
+			return
+		}
+		if msg.Deleted {
+			err = ErrMessageDeleted
+			return
+		}
+
+		change(&msg)
+
+		if r.store != nil {
+			if err = r.store.UpdateMessage(r.Name, &msg); err != nil {
+				log.Default().Printf("[ %s ] Failed persisting %s of message %d: %v", r.Name, t, id, err)
+				return
+			}
+		}
+
+		r.mu.Lock()
+		r.Messages[i] = &msg
+		r.mu.Unlock()
+		changed = &msg
+
+		// A deleted reply no longer counts towards its thread.
+		if msg.Deleted && msg.ParentID != 0 {
+			r.removeReply(msg.ParentID)
+		}
+
+		data, encErr := protocol.Encode(t, r.Name, "", &msg)
+		if encErr != nil {
+			log.Default().Printf("Failed marshalling %s event into JSON", t)
+			return
+		}
+		r.broadcast(data, nil)
+	})
+	if !ok {
+		return nil, ErrRoomStopped
+	}
+
+	return changed, err
+}
+
+// messageIndex returns the index of the message with the given ID in r.Messages, or -1. The
+// caller must hold r.mu.
+func (r *Room) messageIndex(id uint64) int {
+	i := sort.Search(len(r.Messages), func(i int) bool { return r.Messages[i].ID >= id })
+	if i < len(r.Messages) && r.Messages[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// HandleMessage serves /rooms/{name}/messages/{id} and its sub-resources. PATCH edits the
+// message with the content form value and DELETE deletes it; editing is only allowed to the
+// message's author and deleting to the author and the room's moderators. GET on /rooms/{name}/messages/{id}/thread lists the replies of the message
+// and /rooms/{name}/messages/{id}/reactions adds or removes reactions.
+func (r *Room) HandleMessage(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/rooms/"+r.Name+"/messages/"), "/")
+	id, err := strconv.ParseUint(segments[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	resource := strings.Join(segments[1:], "/")
+	if resource == "thread" {
+		r.getThread(w, req, id)
+		return
+	}
+	if resource != "" && resource != "reactions" {
+		http.NotFound(w, req)
+		return
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	username := user.Username
+
+	if resource == "reactions" {
+		r.handleReactions(w, req, id, username)
+		return
+	}
+
+	var msg *models.Message
+	switch req.Method {
+	case http.MethodPatch:
+		content := req.Form.Get("content")
+		if err := protocol.ValidateContent(content); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err = r.EditMessage(username, id, content)
+	case http.MethodDelete:
+		msg, err = r.DeleteMessage(username, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	responseData, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, "Message JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(responseData)
+}
+
+func messageErrorStatus(err error) int {
+	switch err {
+	case ErrMessageNotFound, ErrInviteNotFound, ErrNotParticipant:
+		return http.StatusNotFound
+	case ErrNotAuthor, ErrForbidden, ErrMuted, ErrNotInvited, ErrWrongPassword, ErrConversationAccess:
+		return http.StatusForbidden
+	case ErrMessageDeleted, ErrRoomStopped, ErrAlreadyParticipant, ErrGroupFull, ErrArchived:
+		return http.StatusConflict
+	case ErrNestedReply, ErrInvalidRole, ErrInvalidDuration, ErrReasonTooLong, ErrInvalidVisibility, ErrInvalidPassword, ErrGroupSize,
+		ErrInvalidCapacity, ErrTopicTooLong, ErrDescriptionTooLong:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// messageErrorCode maps a message change error to an error envelope code.
+func messageErrorCode(err error) string {
+	switch err {
+	case ErrMessageNotFound, ErrMessageDeleted:
+		return protocol.ErrNotFound
+	case ErrNotAuthor, ErrForbidden, ErrMuted, ErrArchived:
+		return protocol.ErrForbidden
+	}
+	return protocol.ErrInvalidPayload
+}
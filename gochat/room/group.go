@@ -0,0 +1,270 @@
+package room
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+const (
+	// GroupPrefix starts the names of the rooms backing group conversations.
+	GroupPrefix = "group:"
+
+	MinGroupSize = 3
+	MaxGroupSize = 10
+)
+
+var (
+	ErrGroupSize          = fmt.Errorf("group conversations must have between %d and %d participants", MinGroupSize, MaxGroupSize)
+	ErrGroupFull          = fmt.Errorf("group conversations cannot have more than %d participants", MaxGroupSize)
+	ErrNotParticipant     = errors.New("user is not a participant of the conversation")
+	ErrAlreadyParticipant = errors.New("user is already a participant of the conversation")
+)
+
+// GroupConversation is an ad-hoc private conversation between a few users. Like a direct
+// conversation it is backed by an invite-only room whose members are the participants, but
+// participants can be added and removed after it is created. The creator owns the conversation.
+type GroupConversation struct {
+	*Room
+}
+
+// ConversationInfo describes a direct or group conversation to its participants.
+type ConversationInfo struct {
+	Name string `json:"name"`
+	// Kind is "direct" or "group".
+	Kind         string   `json:"kind"`
+	Participants []string `json:"participants"`
+	// LastMessage is the newest message of the conversation the user can read, if any.
+	LastMessage *models.Message `json:"last_message,omitempty"`
+}
+
+// NewGroupConversation creates a conversation between creator and participants and starts its
+// room.
+func NewGroupConversation(creator string, participants []string, messageStore store.MessageStore) (*GroupConversation, error) {
+	users := map[string]bool{creator: true}
+	for _, username := range participants {
+		users[username] = true
+	}
+	if len(users) < MinGroupSize || len(users) > MaxGroupSize {
+		return nil, ErrGroupSize
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	// Participants may keep several sockets open, so the number of connections is not limited.
+	r := NewRoom(GroupPrefix+base64.RawURLEncoding.EncodeToString(id), 0, messageStore)
+	r.group = true
+	r.SetVisibility(models.VisibilityInvite, "")
+	r.SetOwner(creator)
+	for username := range users {
+		r.AddMember(username)
+	}
+
+	return &GroupConversation{Room: r}, nil
+}
+
+// RestoreGroupConversation recreates a conversation from its stored room record.
+func RestoreGroupConversation(record *store.RoomRecord, messageStore store.MessageStore) (*GroupConversation, error) {
+	if !record.Group || !strings.HasPrefix(record.Name, GroupPrefix) {
+		return nil, fmt.Errorf("room '%s' is not a group conversation", record.Name)
+	}
+
+	r, err := RestoreRoom(record, messageStore)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupConversation{Room: r}, nil
+}
+
+// Participants returns the participants of the conversation, sorted by name.
+func (g *GroupConversation) Participants() []string {
+	return g.Members()
+}
+
+// HasParticipant reports whether username takes part in the conversation.
+func (g *GroupConversation) HasParticipant(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.members[username]
+}
+
+// AddParticipant adds username to the conversation on behalf of actor, who must be a participant.
+// Newcomers only see the messages sent after they were added unless shareHistory is set.
+func (g *GroupConversation) AddParticipant(actor string, username string, shareHistory bool) error {
+	if !g.HasParticipant(actor) {
+		return ErrForbidden
+	}
+
+	var err error
+	ok := g.exec(func() {
+		g.mu.Lock()
+		switch {
+		case g.members[username]:
+			err = ErrAlreadyParticipant
+		case len(g.members) >= MaxGroupSize:
+			err = ErrGroupFull
+		}
+		g.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		err = g.updateRecord(func() func() {
+			g.members[username] = true
+			if !shareHistory {
+				g.historyFrom[username] = g.lastID
+			}
+			return func() {
+				delete(g.members, username)
+				delete(g.historyFrom, username)
+			}
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting participant %s: %v", g.Name, username, err)
+			return
+		}
+
+		g.announceSystem(fmt.Sprintf("%s added %s to the conversation", actor, username))
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// RemoveParticipant removes username from the conversation on behalf of actor and disconnects
+// them. Participants can leave on their own; removing others requires outranking them, which
+// only the owner does. When the owner leaves, the first remaining participant by name takes over.
+func (g *GroupConversation) RemoveParticipant(actor string, username string) error {
+	if actor != username {
+		if err := g.authorize(actor, username, PermKick); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	ok := g.exec(func() {
+		if !g.HasParticipant(username) {
+			err = ErrNotParticipant
+			return
+		}
+
+		err = g.updateRecord(func() func() {
+			owner, role, historyFrom := g.owner, g.roles[username], g.historyFrom[username]
+			delete(g.members, username)
+			delete(g.roles, username)
+			delete(g.historyFrom, username)
+			if g.owner == username {
+				g.owner = ""
+				if remaining := g.memberList(); len(remaining) > 0 {
+					g.owner = remaining[0]
+				}
+			}
+			return func() {
+				g.members[username] = true
+				g.owner = owner
+				if role != "" {
+					g.roles[username] = role
+				}
+				if historyFrom != 0 {
+					g.historyFrom[username] = historyFrom
+				}
+			}
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting removal of participant %s: %v", g.Name, username, err)
+			return
+		}
+
+		if actor == username {
+			g.announceSystem(fmt.Sprintf("%s left the conversation", username))
+		} else {
+			g.announceSystem(fmt.Sprintf("%s removed %s from the conversation", actor, username))
+		}
+		g.disconnectUser(username, "removed from the conversation", "")
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// Info returns the description of the conversation as seen by username.
+func (g *GroupConversation) Info(username string) *ConversationInfo {
+	return &ConversationInfo{
+		Name:         g.Name,
+		Kind:         "group",
+		Participants: g.Participants(),
+		LastMessage:  g.lastMessage(username),
+	}
+}
+
+// HandleParticipants serves /rooms/{name}/participants. GET lists the participants; PUT adds the
+// user given by the user form value, who also sees the earlier messages if share_history is set;
+// DELETE removes the user given by the user form value, or the caller if it is missing.
+func (g *GroupConversation) HandleParticipants(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !g.HasParticipant(user.Username) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		responseData, err := json.Marshal(g.Participants())
+		if err != nil {
+			http.Error(w, "Participants JSON marshalling failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write(responseData)
+		return
+	case http.MethodPut:
+		username := req.Form.Get("user")
+		if username == "" {
+			http.Error(w, "Invalid user", http.StatusBadRequest)
+			return
+		}
+		shareHistory, _ := strconv.ParseBool(req.Form.Get("share_history"))
+		err = g.AddParticipant(user.Username, username, shareHistory)
+	case http.MethodDelete:
+		username := req.Form.Get("user")
+		if username == "" {
+			username = user.Username
+		}
+		err = g.RemoveParticipant(user.Username, username)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package room
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+
+	models "github.com/stefan-chivu/gochat/gochat/models"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// HistoryQuery selects a page of a room's history. Before and After are exclusive message ID
+// bounds; zero means unbounded. Without After the page holds the newest matching messages and
+// pagination moves backwards in time; with only After it holds the oldest and moves forwards.
+type HistoryQuery struct {
+	Before uint64
+	After  uint64
+	Limit  int
+	// Parent selects the replies of a thread. Zero selects the main stream of top-level messages.
+	Parent uint64
+	// Since hides the messages with IDs up to Since, such as the messages sent to a group
+	// conversation before the reader was added to it.
+	Since uint64
+}
+
+// HistoryPage is a page of room history, ordered oldest first.
+type HistoryPage struct {
+	Messages []*models.Message `json:"messages"`
+	// NextCursor is the message ID to pass as "before" (or "after" when paging forwards) to get
+	// the next page. It is omitted when there are no more messages in that direction.
+	NextCursor uint64 `json:"next_cursor,omitempty"`
+}
+
+// ParseHistoryQuery reads the before, after and limit parameters of a history request.
+func ParseHistoryQuery(values url.Values) (*HistoryQuery, error) {
+	q := &HistoryQuery{Limit: defaultHistoryLimit}
+
+	for name, dst := range map[string]*uint64{"before": &q.Before, "after": &q.After} {
+		if v := values.Get(name); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s' parameter", name)
+			}
+			*dst = id
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			return nil, fmt.Errorf("'limit' must be a value between 1 and %d", maxHistoryLimit)
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
+
+// History returns the page of the room's messages selected by q.
+func (r *Room) History(q *HistoryQuery) *HistoryPage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Messages are appended by the hub in ID order, so the bounds can be binary searched.
+	lo := 0
+	if floor := max(q.After, q.Since); floor != 0 {
+		lo = sort.Search(len(r.Messages), func(i int) bool { return r.Messages[i].ID > floor })
+	}
+	hi := len(r.Messages)
+	if q.Before != 0 {
+		hi = sort.Search(len(r.Messages), func(i int) bool { return r.Messages[i].ID >= q.Before })
+	}
+
+	page := &HistoryPage{Messages: []*models.Message{}}
+	if q.After != 0 && q.Before == 0 {
+		for i := lo; i < hi; i++ {
+			if r.Messages[i].ParentID != q.Parent {
+				continue
+			}
+			if len(page.Messages) == q.Limit {
+				page.NextCursor = page.Messages[len(page.Messages)-1].ID
+				break
+			}
+			page.Messages = append(page.Messages, r.Messages[i])
+		}
+		return page
+	}
+
+	for i := hi - 1; i >= lo; i-- {
+		if r.Messages[i].ParentID != q.Parent {
+			continue
+		}
+		if len(page.Messages) == q.Limit {
+			page.NextCursor = page.Messages[len(page.Messages)-1].ID
+			break
+		}
+		page.Messages = append(page.Messages, r.Messages[i])
+	}
+	for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+		page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+	}
+
+	return page
+}
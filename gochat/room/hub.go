@@ -0,0 +1,273 @@
+package room
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+)
+
+// nonceWindow is how many of the newest messages are searched for a repeated nonce.
+const nonceWindow = 500
+
+// post is a chat message handed to the hub. from and ref identify the sending client and the
+// id of its envelope so the hub can acknowledge it; both are empty for server messages.
+type post struct {
+	msg  *models.Message
+	from *client
+	ref  string
+}
+
+// joinRequest asks the hub to add a client to the room. The hub answers on accepted.
+type joinRequest struct {
+	client   *client
+	accepted chan bool
+}
+
+// run is the room hub. It is the only goroutine that mutates the client set and the message
+// history; connections talk to it through the join, leave, forward and ops channels. The mutex
+// is still taken on writes so that snapshot accessors can read consistently from other
+// goroutines.
+func (r *Room) run() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(typingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req := <-r.join:
+			req.accepted <- r.addClient(req.client)
+		case ws := <-r.leave:
+			r.removeClient(ws)
+		case p := <-r.forward:
+			r.handleRoomMsg(p)
+		case op := <-r.ops:
+			op()
+		case <-ticker.C:
+			r.expireTyping()
+		case <-r.quit:
+			r.closeClients()
+			return
+		}
+	}
+}
+
+func (r *Room) addClient(c *client) bool {
+	r.mu.Lock()
+	if r.Capacity > 0 && len(r.clients) >= r.Capacity {
+		r.mu.Unlock()
+		return false
+	}
+	r.clients[c.conn] = c
+	r.mu.Unlock()
+
+	if r.Presence != nil {
+		r.Presence.Connect(c.username, r.Name)
+	}
+	r.notifyOccupancy()
+	r.greet(c)
+	if r.connections(c.username) == 1 {
+		r.announcePresence(c.username, protocol.PresenceJoin, c)
+	}
+	return true
+}
+
+func (r *Room) removeClient(ws *websocket.Conn) {
+	r.mu.Lock()
+	c, ok := r.clients[ws]
+	r.mu.Unlock()
+
+	if ok {
+		r.dropClient(c)
+	}
+}
+
+// dropClient removes c from the room and stops its writer. When c was the user's last
+// connection, the user stops typing and leaves. It must only be called by the hub.
+func (r *Room) dropClient(c *client) {
+	r.mu.Lock()
+	_, ok := r.clients[c.conn]
+	delete(r.clients, c.conn)
+	r.mu.Unlock()
+
+	c.close()
+	if !ok {
+		return
+	}
+	if r.Presence != nil {
+		r.Presence.Disconnect(c.username, r.Name)
+	}
+	r.notifyOccupancy()
+	if r.connections(c.username) > 0 {
+		return
+	}
+
+	r.setTyping(c.username, false)
+	r.announcePresence(c.username, protocol.PresenceLeave, nil)
+}
+
+// notifyOccupancy reports the number of connections to OnOccupancy. It must only be called by the
+// hub.
+func (r *Room) notifyOccupancy() {
+	if r.OnOccupancy != nil {
+		r.OnOccupancy(r, r.ClientCount())
+	}
+}
+
+func (r *Room) handleRoomMsg(p *post) {
+	msg := p.msg
+	log.Default().Printf("[ %s ] %s : %s", r.Name, msg.Username, msg.Content)
+
+	if existing := r.findByNonce(msg.Username, msg.Nonce); existing != nil {
+		// The sender is retrying a message that was already accepted, e.g. after a reconnect.
+		// Acknowledge the original instead of storing a duplicate.
+		log.Default().Printf("[ %s ] duplicate nonce from %s; acknowledging message %d", r.Name, msg.Username, existing.ID)
+		r.ack(p, existing.ID)
+		return
+	}
+
+	if p.from != nil && r.Mute(msg.Username) != nil {
+		r.refuse(p, ErrMuted)
+		return
+	}
+	if r.Archived() {
+		r.refuse(p, ErrArchived)
+		return
+	}
+
+	if msg.ParentID != 0 {
+		if err := r.addReply(msg.ParentID); err != nil {
+			r.refuse(p, err)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	r.lastID++
+	msg.ID = r.lastID
+	msg.Timestamp = time.Now().UTC()
+	r.Messages = append(r.Messages, msg)
+	r.mu.Unlock()
+	if r.store != nil {
+		if err := r.store.AppendMessage(r.Name, msg); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting message: %v", r.Name, err)
+		}
+	}
+	msgData, err := protocol.Encode(protocol.TypeChat, r.Name, "", msg)
+	if err != nil {
+		log.Default().Printf("Failed marshalling message into JSON")
+		return
+	}
+	r.broadcast(msgData, nil)
+	r.ack(p, msg.ID)
+
+	if p.from != nil {
+		r.setTyping(msg.Username, false)
+	}
+}
+
+// ack confirms to the sender of p that its message was stored as messageID.
+func (r *Room) ack(p *post, messageID uint64) {
+	if p.from == nil {
+		return
+	}
+
+	ack, err := protocol.Encode(protocol.TypeAck, r.Name, p.ref, &protocol.AckPayload{MessageID: messageID, Nonce: p.msg.Nonce})
+	if err != nil {
+		log.Default().Printf("Failed marshalling ack into JSON")
+		return
+	}
+	r.deliver(p.from, ack)
+}
+
+// refuse answers the sender of p with an error envelope instead of an ack.
+func (r *Room) refuse(p *post, err error) {
+	if p.from == nil {
+		log.Default().Printf("[ %s ] Failed posting server message: %v", r.Name, err)
+		return
+	}
+
+	data, encErr := protocol.EncodeError(r.Name, &protocol.Error{Code: messageErrorCode(err), Message: err.Error(), Ref: p.ref})
+	if encErr != nil {
+		log.Default().Printf("Failed marshalling error envelope into JSON")
+		return
+	}
+	r.deliver(p.from, data)
+}
+
+// findByNonce looks for a recent message of username carrying nonce.
+func (r *Room) findByNonce(username string, nonce string) *models.Message {
+	if nonce == "" {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.Messages) - 1; i >= 0 && i >= len(r.Messages)-nonceWindow; i-- {
+		if msg := r.Messages[i]; msg.Username == username && msg.Nonce == nonce {
+			return msg
+		}
+	}
+	return nil
+}
+
+// deliver queues data for a single client. It must only be called by the hub.
+func (r *Room) deliver(c *client, data []byte) {
+	if !r.hasClient(c.conn) {
+		return
+	}
+	if !c.enqueue(data, r.SendPolicy, r.SendTimeout) {
+		log.Default().Printf("[ %s ] %s is too slow; disconnecting (policy: %s)", r.Name, c.username, r.SendPolicy)
+		r.dropClient(c)
+	}
+}
+
+// register hands the client to the hub. It returns false if the room is full or stopped.
+func (r *Room) register(c *client) bool {
+	req := &joinRequest{client: c, accepted: make(chan bool, 1)}
+	select {
+	case r.join <- req:
+		return <-req.accepted
+	case <-r.stopped:
+		return false
+	}
+}
+
+// unregister asks the hub to drop the connection and stop its writer.
+func (r *Room) unregister(ws *websocket.Conn) {
+	select {
+	case r.leave <- ws:
+	case <-r.stopped:
+	}
+}
+
+// publish hands a message to the hub for persistence and broadcast.
+func (r *Room) publish(p *post) {
+	select {
+	case r.forward <- p:
+	case <-r.stopped:
+	}
+}
+
+// exec runs op on the hub goroutine and waits for it to finish. It returns false, without running
+// op, if the room is stopped.
+func (r *Room) exec(op func()) bool {
+	done := make(chan struct{})
+	select {
+	case r.ops <- func() { op(); close(done) }:
+		<-done
+		return true
+	case <-r.stopped:
+		return false
+	}
+}
+
+// Stop disconnects every client and terminates the room hub. It blocks until the hub has
+// exited and is safe to call more than once.
+func (r *Room) Stop() {
+	r.Close("room closed")
+}
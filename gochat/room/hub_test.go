@@ -0,0 +1,256 @@
+package room
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+)
+
+func TestHubRegisterAndUnregister(t *testing.T) {
+	r := NewRoom("hub", 0, nil)
+	defer r.Stop()
+	srv := newTestServer(t, r)
+
+	conns := make([]*websocket.Conn, 0, 5)
+	for _, username := range []string{"alice", "bob", "bob", "carol", "dave"} {
+		conns = append(conns, dial(t, srv, username))
+	}
+	waitFor(t, 5*time.Second, "clients to register", func() bool { return r.ClientCount() == 5 })
+	if got, want := len(r.Users()), 4; got != want {
+		t.Errorf("got %d users, want %d", got, want)
+	}
+
+	for _, conn := range conns[:3] {
+		conn.Close()
+	}
+	waitFor(t, 5*time.Second, "clients to unregister", func() bool { return r.ClientCount() == 2 })
+	if got := r.Users(); len(got) != 2 || got[0] != "carol" || got[1] != "dave" {
+		t.Errorf("got users %v, want [carol dave]", got)
+	}
+}
+
+func TestHubRegisterRespectsCapacity(t *testing.T) {
+	r := NewRoom("small", 2, nil)
+	defer r.Stop()
+	srv := newTestServer(t, r)
+
+	dial(t, srv, "alice")
+	dial(t, srv, "bob")
+	waitFor(t, 5*time.Second, "clients to register", func() bool { return r.ClientCount() == 2 })
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?username=carol"
+	if conn, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		conn.Close()
+		t.Fatal("a client was accepted beyond the capacity")
+	} else if resp == nil || resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("got %v, want %d Not Acceptable", err, http.StatusNotAcceptable)
+	}
+	if got := r.ClientCount(); got != 2 {
+		t.Errorf("got %d clients, want 2", got)
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	r := NewRoom("hub", 0, nil)
+	defer r.Stop()
+	srv := newTestServer(t, r)
+
+	sender := dial(t, srv, "alice")
+	receivers := []*websocket.Conn{dial(t, srv, "bob"), dial(t, srv, "carol")}
+	waitFor(t, 5*time.Second, "clients to register", func() bool { return r.ClientCount() == 3 })
+
+	data, err := protocol.Encode(protocol.TypeChat, r.Name, "1", &protocol.ChatPayload{Content: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range append(receivers, sender) {
+		readUntil(t, conn, `"content":"hello"`, 5*time.Second)
+	}
+	if got := r.MessageCount(); got != 1 {
+		t.Errorf("got %d messages in history, want 1", got)
+	}
+}
+
+// TestHubConcurrentClients connects, talks and disconnects from many goroutines at once. It is
+// meant to be run with the race detector.
+func TestHubConcurrentClients(t *testing.T) {
+	r := NewRoom("busy", 0, nil)
+	defer r.Stop()
+	srv := newTestServer(t, r)
+
+	data, err := protocol.Encode(protocol.TypeChat, r.Name, "", &protocol.ChatPayload{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clients are dialed up front: dial fails the test, which only the test goroutine may do.
+	conns := make([]*websocket.Conn, 10)
+	for i := range conns {
+		conns[i] = dial(t, srv, "user")
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			for j := 0; j < 10; j++ {
+				if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					t.Errorf("writing message %d: %v", j, err)
+					return
+				}
+				r.Info()
+				r.Users()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	waitFor(t, 5*time.Second, "clients to unregister", func() bool { return r.ClientCount() == 0 })
+}
+
+func TestHubStopWithConnectedClients(t *testing.T) {
+	r := NewRoom("closing", 0, nil)
+	srv := newTestServer(t, r)
+
+	conns := []*websocket.Conn{dial(t, srv, "alice"), dial(t, srv, "bob")}
+	waitFor(t, 5*time.Second, "clients to register", func() bool { return r.ClientCount() == 2 })
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("got %v, want a going away close frame", err)
+			}
+			break
+		}
+	}
+
+	if got := r.ClientCount(); got != 0 {
+		t.Errorf("got %d clients after Stop, want 0", got)
+	}
+	if r.exec(func() {}) {
+		t.Error("the hub ran an operation after Stop")
+	}
+	// The upgrade still succeeds, but the stopped hub refuses the client.
+	late := dial(t, srv, "late")
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := late.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("got %v after Stop, want the connection refused", err)
+	}
+	// Stop is idempotent.
+	r.Stop()
+}
+
+// TestStopDoesNotHoldRoomLock checks that readers of the room are not held up while Stop sends
+// the close frame to a client that does not read.
+func TestStopDoesNotHoldRoomLock(t *testing.T) {
+	r := NewRoom("closing", 0, nil)
+	srv := newTestServer(t, r)
+	stuck := dial(t, srv, "stuck")
+	waitFor(t, 5*time.Second, "client to join", func() bool { return r.ClientCount() == 1 })
+
+	// Flood the client until its writer is blocked on the socket, which the close frame then
+	// has to wait for.
+	padding := []byte(strings.Repeat("x", floodMessageSize))
+	for i := 0; i < floodMessages; i++ {
+		r.exec(func() { r.broadcast(padding, nil) })
+	}
+	queued := queueLength(r)
+	waitFor(t, 10*time.Second, "the writer to block", func() bool {
+		time.Sleep(200 * time.Millisecond)
+		previous := queued
+		queued = queueLength(r)
+		return queued > 0 && queued == previous
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+
+	start := time.Now()
+	waitFor(t, time.Second, "the client to be dropped", func() bool { return r.ClientCount() == 0 })
+	r.Info()
+	if elapsed := time.Since(start); elapsed > deliveryBound {
+		t.Errorf("reading the room took %v while the close frame was pending", elapsed)
+	}
+
+	stuck.Close()
+	select {
+	case <-stopped:
+	case <-time.After(2 * writeWait):
+		t.Fatal("Stop did not return")
+	}
+}
+
+// queueLength returns the number of messages queued for the clients of r.
+func queueLength(r *Room) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, c := range r.clients {
+		n += len(c.send)
+	}
+	return n
+}
+
+// TestHubRejectsMalformedFrames checks that frames that cannot be decoded are answered with an
+// error frame and leave the connection open.
+func TestHubRejectsMalformedFrames(t *testing.T) {
+	r := NewRoom("strict", 0, nil)
+	defer r.Stop()
+	srv := newTestServer(t, r)
+
+	conn := dial(t, srv, "alice")
+	waitFor(t, 5*time.Second, "client to join", func() bool { return r.ClientCount() == 1 })
+	wrongRoom, err := protocol.Encode(protocol.TypeChat, "other", "1", &protocol.ChatPayload{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frame := range []struct {
+		messageType int
+		data        string
+		code        string
+	}{
+		{messageType: websocket.BinaryMessage, data: "hello", code: protocol.ErrMalformed},
+		{messageType: websocket.TextMessage, data: "{not json", code: protocol.ErrMalformed},
+		{messageType: websocket.TextMessage, data: string(wrongRoom), code: protocol.ErrWrongRoom},
+	} {
+		if err := conn.WriteMessage(frame.messageType, []byte(frame.data)); err != nil {
+			t.Fatal(err)
+		}
+		readUntil(t, conn, `"`+frame.code+`"`, 5*time.Second)
+	}
+
+	if got := r.ClientCount(); got != 1 {
+		t.Errorf("got %d clients after the rejected frames, want 1", got)
+	}
+}
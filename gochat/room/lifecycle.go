@@ -0,0 +1,173 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+const (
+	maxTopicLength       = 120
+	maxDescriptionLength = 1000
+)
+
+var (
+	ErrArchived           = errors.New("room is archived")
+	ErrInvalidCapacity    = errors.New("capacity cannot be negative")
+	ErrTopicTooLong       = fmt.Errorf("topic should not exceed %d characters", maxTopicLength)
+	ErrDescriptionTooLong = fmt.Errorf("description should not exceed %d characters", maxDescriptionLength)
+)
+
+// RoomUpdate lists the settings changed by Update. Nil fields are left unchanged.
+type RoomUpdate struct {
+	Capacity    *int
+	Topic       *string
+	Description *string
+	Archived    *bool
+}
+
+// Info returns the description of the room shown in room lists.
+func (r *Room) Info() *RoomInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &RoomInfo{
+		Capacity:    r.Capacity,
+		ClientCount: len(r.clients),
+		Owner:       r.owner,
+		Visibility:  r.visibility,
+		Topic:       r.topic,
+		Description: r.description,
+		Archived:    r.archived,
+	}
+}
+
+// Archived reports whether the room is archived.
+func (r *Room) Archived() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.archived
+}
+
+// CheckUpdate reports whether actor may apply update, without changing the room. Update only
+// fails beyond its checks if the room cannot be saved.
+func (r *Room) CheckUpdate(actor string, update *RoomUpdate) error {
+	if update.Capacity != nil && *update.Capacity < 0 {
+		return ErrInvalidCapacity
+	}
+	if update.Topic != nil && len(*update.Topic) > maxTopicLength {
+		return ErrTopicTooLong
+	}
+	if update.Description != nil && len(*update.Description) > maxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	if update.Capacity != nil && !r.Can(actor, PermSetCapacity) ||
+		(update.Topic != nil || update.Description != nil) && !r.Can(actor, PermEditDetails) ||
+		update.Archived != nil && !r.Can(actor, PermArchive) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Update changes the settings of the room on behalf of actor, saves the room and announces the
+// changes to its clients. Lowering the capacity below the number of connections does not
+// disconnect anybody; it only keeps newcomers out.
+func (r *Room) Update(actor string, update *RoomUpdate) error {
+	if err := r.CheckUpdate(actor, update); err != nil {
+		return err
+	}
+
+	var err error
+	ok := r.exec(func() {
+		var changes []string
+		err = r.updateRecord(func() func() {
+			capacity, topic, description, archived := r.Capacity, r.topic, r.description, r.archived
+			if update.Capacity != nil && *update.Capacity != r.Capacity {
+				r.Capacity = *update.Capacity
+				changes = append(changes, "set the capacity to "+strconv.Itoa(r.Capacity))
+			}
+			if update.Topic != nil && *update.Topic != r.topic {
+				r.topic = *update.Topic
+				changes = append(changes, fmt.Sprintf("changed the topic to '%s'", r.topic))
+			}
+			if update.Description != nil && *update.Description != r.description {
+				r.description = *update.Description
+				changes = append(changes, "changed the description")
+			}
+			if update.Archived != nil && *update.Archived != r.archived {
+				r.archived = *update.Archived
+				if r.archived {
+					changes = append(changes, "archived the room")
+				} else {
+					changes = append(changes, "reopened the room")
+				}
+			}
+			return func() {
+				r.Capacity, r.topic, r.description, r.archived = capacity, topic, description, archived
+			}
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting settings: %v", r.Name, err)
+			return
+		}
+
+		for _, change := range changes {
+			r.announceSystem(actor + " " + change)
+		}
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// restoreSettings loads the topic, description and archive state of a stored room record.
+func (r *Room) restoreSettings(record *store.RoomRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.topic = record.Topic
+	r.description = record.Description
+	r.archived = record.Archived
+}
+
+// Close disconnects every client with a going away close frame carrying reason and terminates the
+// room hub. It blocks until the hub has exited. Only the first call to Close or Stop decides the
+// reason.
+func (r *Room) Close(reason string) {
+	r.stopOnce.Do(func() {
+		r.closeReason = reason
+		close(r.quit)
+	})
+	<-r.stopped
+}
+
+// closeClients drops every client and sends it the close frame. It must only be called by the hub
+// as it exits. The close frames are sent after r.mu is released, so a slow socket does not hold up
+// readers of the room.
+func (r *Room) closeClients() {
+	r.mu.Lock()
+	closed := make([]*client, 0, len(r.clients))
+	for ws, c := range r.clients {
+		delete(r.clients, ws)
+		closed = append(closed, c)
+	}
+	frame := websocket.FormatCloseMessage(websocket.CloseGoingAway, r.closeReason)
+	r.mu.Unlock()
+
+	for _, c := range closed {
+		c.conn.WriteControl(websocket.CloseMessage, frame, deadline())
+		c.close()
+	}
+
+	if r.Presence != nil {
+		for _, c := range closed {
+			r.Presence.Disconnect(c.username, r.Name)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// maxReasonLength is the maximum length of the reason given for a moderation action, in bytes.
+const maxReasonLength = 256
+
+var (
+	ErrMuted            = errors.New("you are muted in this room")
+	ErrInvalidDuration  = errors.New("duration must be positive")
+	ErrReasonTooLong    = fmt.Errorf("reason should not exceed %d characters", maxReasonLength)
+	ErrUnknownCommand   = errors.New("unknown command")
+	ErrCommandArguments = errors.New("invalid command arguments")
+)
+
+// rank orders roles so moderators can only act on members and owners on everybody else.
+var rank = map[models.Role]int{
+	models.RoleMember:    0,
+	models.RoleModerator: 1,
+	models.RoleOwner:     2,
+}
+
+// authorize checks that actor is allowed to perform p on username.
+func (r *Room) authorize(actor string, username string, p Permission) error {
+	if !r.Can(actor, p) {
+		return ErrForbidden
+	}
+	if rank[r.Role(actor)] <= rank[r.Role(username)] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Ban returns the ban of username if one is in effect.
+func (r *Room) Ban(username string) *models.Sanction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ban, ok := r.bans[username]; ok && ban.Active(time.Now()) {
+		return ban
+	}
+	return nil
+}
+
+// Mute returns the mute of username if one is in effect.
+func (r *Room) Mute(username string) *models.Sanction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if mute, ok := r.mutes[username]; ok && mute.Active(time.Now()) {
+		return mute
+	}
+	return nil
+}
+
+// Bans returns the bans in effect in the room, by username.
+func (r *Room) Bans() map[string]*models.Sanction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return activeSanctions(r.bans)
+}
+
+// Mutes returns the mutes in effect in the room, by username.
+func (r *Room) Mutes() map[string]*models.Sanction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return activeSanctions(r.mutes)
+}
+
+// Kick disconnects every connection of username from the room on behalf of actor.
+func (r *Room) Kick(actor string, username string, reason string) error {
+	if err := validateReason(reason); err != nil {
+		return err
+	}
+	if err := r.authorize(actor, username, PermKick); err != nil {
+		return err
+	}
+
+	ok := r.exec(func() {
+		r.announceModeration(fmt.Sprintf("%s was kicked by %s", username, actor), reason)
+		r.disconnectUser(username, "kicked", reason)
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return nil
+}
+
+// BanUser bans username from the room on behalf of actor and disconnects them. A zero duration
+// bans them permanently.
+func (r *Room) BanUser(actor string, username string, reason string, duration time.Duration) error {
+	if duration < 0 {
+		return ErrInvalidDuration
+	}
+	if err := validateReason(reason); err != nil {
+		return err
+	}
+	if err := r.authorize(actor, username, PermBan); err != nil {
+		return err
+	}
+
+	var err error
+	ok := r.exec(func() {
+		ban := newSanction(actor, reason, duration)
+		if err = r.updateRecord(func() func() { return setSanction(r.bans, username, ban) }); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting ban of %s: %v", r.Name, username, err)
+			return
+		}
+
+		r.announceModeration(fmt.Sprintf("%s was banned by %s %s", username, actor, describeDuration(duration)), reason)
+		r.disconnectUser(username, "banned", reason)
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// Unban lifts the ban of username on behalf of actor.
+func (r *Room) Unban(actor string, username string) error {
+	if !r.Can(actor, PermBan) {
+		return ErrForbidden
+	}
+
+	return r.liftSanction(r.bans, actor, username, "unbanned")
+}
+
+// MuteUser prevents username from posting and editing messages in the room for duration, on
+// behalf of actor.
+func (r *Room) MuteUser(actor string, username string, reason string, duration time.Duration) error {
+	if duration <= 0 {
+		return ErrInvalidDuration
+	}
+	if err := validateReason(reason); err != nil {
+		return err
+	}
+	if err := r.authorize(actor, username, PermMute); err != nil {
+		return err
+	}
+
+	var err error
+	ok := r.exec(func() {
+		mute := newSanction(actor, reason, duration)
+		if err = r.updateRecord(func() func() { return setSanction(r.mutes, username, mute) }); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting mute of %s: %v", r.Name, username, err)
+			return
+		}
+
+		r.announceModeration(fmt.Sprintf("%s was muted by %s %s", username, actor, describeDuration(duration)), reason)
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// Unmute lifts the mute of username on behalf of actor.
+func (r *Room) Unmute(actor string, username string) error {
+	if !r.Can(actor, PermMute) {
+		return ErrForbidden
+	}
+
+	return r.liftSanction(r.mutes, actor, username, "unmuted")
+}
+
+// liftSanction removes the sanction of username from sanctions, which must be r.bans or
+// r.mutes, and announces it. Lifting a sanction that is not in effect is a no-op.
+func (r *Room) liftSanction(sanctions map[string]*models.Sanction, actor string, username string, action string) error {
+	var err error
+	ok := r.exec(func() {
+		r.mu.Lock()
+		_, found := sanctions[username]
+		r.mu.Unlock()
+		if !found {
+			return
+		}
+
+		if err = r.updateRecord(func() func() { return setSanction(sanctions, username, nil) }); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting %s %s: %v", r.Name, action, username, err)
+			return
+		}
+
+		r.announceModeration(fmt.Sprintf("%s was %s by %s", username, action, actor), "")
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+	return err
+}
+
+// disconnectUser closes every connection of username with a policy violation close frame. It
+// must only be called by the hub.
+func (r *Room) disconnectUser(username string, action string, reason string) {
+	message := action
+	if reason != "" {
+		message += ": " + reason
+	}
+	// Close reasons must fit in a control frame.
+	if len(message) > 123 {
+		message = message[:123]
+	}
+
+	r.mu.Lock()
+	var targets []*client
+	for _, c := range r.clients {
+		if c.username == username {
+			targets = append(targets, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range targets {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, message), deadline())
+		r.dropClient(c)
+	}
+}
+
+// announceModeration broadcasts a system message describing a moderation action. It must only be
+// called by the hub.
+func (r *Room) announceModeration(content string, reason string) {
+	if reason != "" {
+		content += ": " + reason
+	}
+	r.announceSystem(content)
+}
+
+// announceSystem broadcasts a system message. Like presence events, system messages are not
+// stored in history. It must only be called by the hub.
+func (r *Room) announceSystem(content string) {
+	log.Default().Printf("[ %s ] %s", r.Name, content)
+
+	data, err := protocol.Encode(protocol.TypeSystem, r.Name, "", &protocol.SystemPayload{Content: content})
+	if err != nil {
+		log.Default().Printf("Failed marshalling system message into JSON")
+		return
+	}
+	r.broadcast(data, nil)
+}
+
+// restoreSanctions loads the bans and mutes of a stored room record.
+func (r *Room) restoreSanctions(record *store.RoomRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for username, ban := range record.Bans {
+		r.bans[username] = ban
+	}
+	for username, mute := range record.Mutes {
+		r.mutes[username] = mute
+	}
+}
+
+func newSanction(actor string, reason string, duration time.Duration) *models.Sanction {
+	now := time.Now().UTC()
+	sanction := &models.Sanction{By: actor, Reason: reason, At: now}
+	if duration > 0 {
+		until := now.Add(duration)
+		sanction.Until = &until
+	}
+	return sanction
+}
+
+// setSanction sets or, if sanction is nil, removes the sanction of username and returns a
+// function undoing the change. The caller must hold r.mu.
+func setSanction(sanctions map[string]*models.Sanction, username string, sanction *models.Sanction) func() {
+	previous, had := sanctions[username]
+	if sanction == nil {
+		delete(sanctions, username)
+	} else {
+		sanctions[username] = sanction
+	}
+
+	return func() {
+		if had {
+			sanctions[username] = previous
+		} else {
+			delete(sanctions, username)
+		}
+	}
+}
+
+// activeSanctions returns a copy of sanctions without the ones that have ended, or nil if none
+// are left. The caller must hold r.mu.
+func activeSanctions(sanctions map[string]*models.Sanction) map[string]*models.Sanction {
+	var active map[string]*models.Sanction
+	now := time.Now()
+	for username, sanction := range sanctions {
+		if sanction.Active(now) {
+			if active == nil {
+				active = make(map[string]*models.Sanction)
+			}
+			active[username] = sanction
+		}
+	}
+	return active
+}
+
+func validateReason(reason string) error {
+	if len(reason) > maxReasonLength {
+		return ErrReasonTooLong
+	}
+	return nil
+}
+
+func describeDuration(duration time.Duration) string {
+	if duration == 0 {
+		return "permanently"
+	}
+	return "for " + duration.String()
+}
+
+// command is a moderation command sent as a chat message, e.g. "/ban bob 1h spamming".
+type command struct {
+	name     string
+	username string
+	duration time.Duration
+	reason   string
+}
+
+// commands are the chat messages starting with a slash that are run instead of being posted.
+var commands = map[string]bool{"kick": true, "ban": true, "unban": true, "mute": true, "unmute": true}
+
+// parseCommand reads a moderation command from the content of a chat message. It returns false
+// if the content is not a command and should be posted as a message.
+func parseCommand(content string) (*command, bool) {
+	if !strings.HasPrefix(content, "/") {
+		return nil, false
+	}
+
+	fields := strings.Fields(content[1:])
+	if len(fields) == 0 || !commands[fields[0]] {
+		return nil, false
+	}
+
+	cmd := &command{name: fields[0]}
+	if len(fields) > 1 {
+		cmd.username = fields[1]
+		fields = fields[2:]
+	} else {
+		fields = nil
+	}
+	if len(fields) > 0 && (cmd.name == "ban" || cmd.name == "mute") {
+		if duration, err := time.ParseDuration(fields[0]); err == nil {
+			cmd.duration = duration
+			fields = fields[1:]
+		}
+	}
+	cmd.reason = strings.Join(fields, " ")
+
+	return cmd, true
+}
+
+// runCommand runs a moderation command on behalf of actor.
+func (r *Room) runCommand(actor string, cmd *command) error {
+	if cmd.username == "" {
+		return ErrCommandArguments
+	}
+
+	switch cmd.name {
+	case "kick":
+		return r.Kick(actor, cmd.username, cmd.reason)
+	case "ban":
+		return r.BanUser(actor, cmd.username, cmd.reason, cmd.duration)
+	case "unban":
+		return r.Unban(actor, cmd.username)
+	case "mute":
+		return r.MuteUser(actor, cmd.username, cmd.reason, cmd.duration)
+	case "unmute":
+		return r.Unmute(actor, cmd.username)
+	}
+	return ErrUnknownCommand
+}
+
+// HandleKick serves /rooms/{name}/kick. POST disconnects the user given by the user form value,
+// with an optional reason.
+func (r *Room) HandleKick(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	actor, username, ok := moderationRequest(w, req)
+	if !ok {
+		return
+	}
+
+	if err := r.Kick(actor, username, req.Form.Get("reason")); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleBans serves /rooms/{name}/bans. GET lists the bans in effect; PUT bans the user given by
+// the user form value, for the optional duration form value or permanently; DELETE lifts the ban.
+func (r *Room) HandleBans(w http.ResponseWriter, req *http.Request) {
+	r.handleSanctions(w, req, PermBan, r.Bans, r.BanUser, r.Unban)
+}
+
+// HandleMutes serves /rooms/{name}/mutes. GET lists the mutes in effect; PUT mutes the user given
+// by the user form value for the required duration form value; DELETE lifts the mute.
+func (r *Room) HandleMutes(w http.ResponseWriter, req *http.Request) {
+	r.handleSanctions(w, req, PermMute, r.Mutes, r.MuteUser, r.Unmute)
+}
+
+func (r *Room) handleSanctions(w http.ResponseWriter, req *http.Request, p Permission,
+	list func() map[string]*models.Sanction,
+	impose func(actor, username, reason string, duration time.Duration) error,
+	lift func(actor, username string) error) {
+	if req.Method == http.MethodGet {
+		user, ok := auth.ContextUser(req.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !r.Can(user.Username, p) {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+
+		sanctions := list()
+		if sanctions == nil {
+			sanctions = map[string]*models.Sanction{}
+		}
+		responseData, err := json.Marshal(sanctions)
+		if err != nil {
+			http.Error(w, "Sanctions JSON marshalling failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write(responseData)
+		return
+	}
+
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	actor, username, ok := moderationRequest(w, req)
+	if !ok {
+		return
+	}
+
+	var err error
+	if req.Method == http.MethodPut {
+		var duration time.Duration
+		if value := req.Form.Get("duration"); value != "" {
+			if duration, err = time.ParseDuration(value); err != nil {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		err = impose(actor, username, req.Form.Get("reason"), duration)
+	} else {
+		err = lift(actor, username)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moderationRequest reads the acting user and the user targeted by a moderation request.
+func moderationRequest(w http.ResponseWriter, req *http.Request) (string, string, bool) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", "", false
+	}
+
+	username := req.Form.Get("user")
+	if username == "" {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return user.Username, username, true
+}
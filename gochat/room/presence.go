@@ -0,0 +1,119 @@
+package room
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+)
+
+const (
+	// typingTimeout is how long a typing indicator lasts unless the client renews it.
+	typingTimeout = 5 * time.Second
+	// typingCheckInterval is how often the hub looks for expired typing indicators.
+	typingCheckInterval = time.Second
+)
+
+// PresenceTracker is told about the connections of users to rooms and about their activity, so
+// that their presence can be followed across rooms.
+type PresenceTracker interface {
+	Connect(username string, room string)
+	Disconnect(username string, room string)
+	Touch(username string)
+}
+
+// Presence and typing events are ephemeral: they are broadcast to the clients currently in the
+// room and never stored in history. Everything in this file must only be called by the hub.
+
+// connections returns the number of connections username has in the room.
+func (r *Room) connections(username string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, c := range r.clients {
+		if c.username == username {
+			count++
+		}
+	}
+	return count
+}
+
+// announcePresence broadcasts that username joined or left the room to everyone except the given
+// client, which may be nil.
+func (r *Room) announcePresence(username string, status string, except *client) {
+	log.Default().Printf("[ %s ] %s: %s", r.Name, username, status)
+
+	data, err := protocol.Encode(protocol.TypePresence, r.Name, "", &protocol.PresencePayload{Username: username, Status: status})
+	if err != nil {
+		log.Default().Printf("Failed marshalling presence event into JSON")
+		return
+	}
+	r.broadcast(data, except)
+}
+
+// greet tells a newly connected client who is already in the room and who is typing.
+func (r *Room) greet(c *client) {
+	users := map[string]bool{}
+	for _, username := range r.GetClients() {
+		users[username] = true
+	}
+
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+
+	for _, username := range names {
+		data, err := protocol.Encode(protocol.TypePresence, r.Name, "", &protocol.PresencePayload{Username: username, Status: protocol.PresenceJoin})
+		if err != nil {
+			continue
+		}
+		r.deliver(c, data)
+	}
+	for username := range r.typing {
+		data, err := protocol.Encode(protocol.TypeTyping, r.Name, "", &protocol.TypingPayload{Username: username, Typing: true})
+		if err != nil {
+			continue
+		}
+		r.deliver(c, data)
+	}
+}
+
+// setTyping starts, renews or stops the typing indicator of username. Only actual changes are
+// broadcast; renewals just push the expiry back.
+func (r *Room) setTyping(username string, typing bool) {
+	_, wasTyping := r.typing[username]
+
+	if typing {
+		r.typing[username] = time.Now().Add(typingTimeout)
+	} else {
+		delete(r.typing, username)
+	}
+
+	if typing != wasTyping {
+		r.announceTyping(username, typing)
+	}
+}
+
+// expireTyping stops the typing indicators that were not renewed in time.
+func (r *Room) expireTyping() {
+	now := time.Now()
+	for username, expiry := range r.typing {
+		if now.After(expiry) {
+			delete(r.typing, username)
+			r.announceTyping(username, false)
+		}
+	}
+}
+
+func (r *Room) announceTyping(username string, typing bool) {
+	data, err := protocol.Encode(protocol.TypeTyping, r.Name, "", &protocol.TypingPayload{Username: username, Typing: typing})
+	if err != nil {
+		log.Default().Printf("Failed marshalling typing event into JSON")
+		return
+	}
+	r.broadcast(data, nil)
+}
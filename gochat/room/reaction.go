@@ -0,0 +1,132 @@
+package room
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+)
+
+// React adds, or removes when remove is set, the reaction of username with emoji on a message and
+// broadcasts the change as an incremental reaction event. Repeating an add or remove is a no-op.
+// Reactions cannot change in archived rooms.
+func (r *Room) React(username string, id uint64, emoji string, remove bool) error {
+	if r.Archived() {
+		return ErrArchived
+	}
+
+	var err error
+
+	ok := r.exec(func() {
+		r.mu.Lock()
+		i := r.messageIndex(id)
+		if i < 0 {
+			r.mu.Unlock()
+			err = ErrMessageNotFound
+			return
+		}
+		msg := *r.Messages[i]
+		r.mu.Unlock()
+
+		if msg.Deleted {
+			err = ErrMessageDeleted
+			return
+		}
+
+		reactions, changed := updateReactions(msg.Reactions, emoji, username, remove)
+		if !changed {
+			return
+		}
+		msg.Reactions = reactions
+
+		if r.store != nil {
+			if err = r.store.UpdateMessage(r.Name, &msg); err != nil {
+				log.Default().Printf("[ %s ] Failed persisting reaction on message %d: %v", r.Name, id, err)
+				return
+			}
+		}
+
+		r.mu.Lock()
+		r.Messages[i] = &msg
+		r.mu.Unlock()
+
+		data, encErr := protocol.Encode(protocol.TypeReaction, r.Name, "", &protocol.ReactionPayload{
+			MessageID: id,
+			Emoji:     emoji,
+			Remove:    remove,
+			Username:  username,
+		})
+		if encErr != nil {
+			log.Default().Printf("Failed marshalling reaction event into JSON")
+			return
+		}
+		r.broadcast(data, nil)
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+
+	return err
+}
+
+// updateReactions returns a copy of reactions with the reaction of username on emoji added or
+// removed, and whether anything changed. The original map is left untouched since it may be
+// shared with history snapshots.
+func updateReactions(reactions map[string][]string, emoji string, username string, remove bool) (map[string][]string, bool) {
+	users := reactions[emoji]
+	i := sort.SearchStrings(users, username)
+	found := i < len(users) && users[i] == username
+	if found != remove {
+		return reactions, false
+	}
+
+	updated := make(map[string][]string, len(reactions)+1)
+	for e, u := range reactions {
+		updated[e] = u
+	}
+
+	if remove {
+		users = append(append([]string{}, users[:i]...), users[i+1:]...)
+	} else {
+		users = append(append(append([]string{}, users[:i]...), username), users[i:]...)
+	}
+
+	if len(users) == 0 {
+		delete(updated, emoji)
+	} else {
+		updated[emoji] = users
+	}
+	if len(updated) == 0 {
+		updated = nil
+	}
+
+	return updated, true
+}
+
+// handleReactions serves /rooms/{name}/messages/{id}/reactions. PUT adds the reaction given by
+// the emoji form value and DELETE removes it.
+func (r *Room) handleReactions(w http.ResponseWriter, req *http.Request, id uint64, username string) {
+	var remove bool
+	switch req.Method {
+	case http.MethodPut:
+	case http.MethodDelete:
+		remove = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	emoji := req.Form.Get("emoji")
+	if err := protocol.ValidateEmoji(emoji); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.React(username, id, emoji, remove); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,192 @@
+package room
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+// registryEventBufferSize is how many events a subscriber may fall behind before events are dropped.
+const registryEventBufferSize = 64
+
+var ErrRoomNotFound = errors.New("room not found")
+
+// RegistryEventType tells what happened to the room of a RegistryEvent.
+type RegistryEventType string
+
+const (
+	RoomCreated RegistryEventType = "created"
+	RoomDeleted RegistryEventType = "deleted"
+)
+
+// RegistryEvent reports a room added to or removed from a RoomRegistry.
+type RegistryEvent struct {
+	Type RegistryEventType
+	Room *Room
+}
+
+// RoomRegistry holds the rooms of a server by name. It is safe for concurrent use and lets callers
+// subscribe to the rooms being created and deleted.
+type RoomRegistry struct {
+	mu sync.RWMutex
+
+	rooms map[string]*Room
+	// pending holds the names of the rooms being created or deleted. The channel is closed once the creation
+	// or deletion is over, whether it succeeded or not.
+	pending map[string]chan struct{}
+	// subscribers are the channels events are sent to. Subscribers that do not keep up miss events
+	// rather than blocking the registry.
+	subscribers map[chan RegistryEvent]struct{}
+}
+
+func NewRoomRegistry() *RoomRegistry {
+	return &RoomRegistry{
+		rooms:       make(map[string]*Room),
+		pending:     make(map[string]chan struct{}),
+		subscribers: make(map[chan RegistryEvent]struct{}),
+	}
+}
+
+// CreateIfAbsent returns the room named name, calling create to make it if there is none. The name
+// is reserved while create runs, so concurrent calls for the same name create the room only once;
+// create should save the room before returning it. create runs without the registry locked, so
+// slow work such as hashing a password or writing to the store does not hold up other callers.
+// created reports whether the room was made by this call.
+func (g *RoomRegistry) CreateIfAbsent(name string, create func() (*Room, error)) (r *Room, created bool, err error) {
+	done, r := g.reserve(name)
+	if done == nil {
+		return r, false, nil
+	}
+
+	r, err = create()
+
+	g.mu.Lock()
+	delete(g.pending, name)
+	if err == nil {
+		g.rooms[name] = r
+		g.notify(RoomCreated, r)
+	}
+	g.mu.Unlock()
+	close(done)
+
+	if err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+// reserve marks name as pending, waiting for other reservations of it to end first. If a room named
+// name exists it is returned instead, with a nil channel. Otherwise the caller must remove name from
+// pending and close the returned channel when done.
+func (g *RoomRegistry) reserve(name string) (chan struct{}, *Room) {
+	for {
+		g.mu.Lock()
+		if r, ok := g.rooms[name]; ok {
+			g.mu.Unlock()
+			return nil, r
+		}
+		wait, ok := g.pending[name]
+		if !ok {
+			done := make(chan struct{})
+			g.pending[name] = done
+			g.mu.Unlock()
+			return done, nil
+		}
+		g.mu.Unlock()
+
+		<-wait
+	}
+}
+
+// Get returns the room named name.
+func (g *RoomRegistry) Get(name string) (*Room, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	r, ok := g.rooms[name]
+	return r, ok
+}
+
+// List returns a snapshot of the rooms, sorted by name. Rooms created or deleted afterwards do not
+// change it.
+func (g *RoomRegistry) List() []*Room {
+	g.mu.RLock()
+	rooms := make([]*Room, 0, len(g.rooms))
+	for _, r := range g.rooms {
+		rooms = append(rooms, r)
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// Len returns the number of rooms.
+func (g *RoomRegistry) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.rooms)
+}
+
+// Delete removes r from the registry, then calls remove unless it is nil. The name of r stays
+// reserved until remove returns, so a room created under the same name meanwhile cannot be undone
+// by it, e.g. by the store deleting the records of r. Delete fails with ErrRoomNotFound if r is no
+// longer registered, e.g. because it was deleted concurrently and another room may have taken its
+// name; otherwise it returns the error of remove. Delete does not stop the room.
+func (g *RoomRegistry) Delete(r *Room, remove func() error) error {
+	g.mu.Lock()
+	if g.rooms[r.Name] != r {
+		g.mu.Unlock()
+		return ErrRoomNotFound
+	}
+	delete(g.rooms, r.Name)
+	done := make(chan struct{})
+	g.pending[r.Name] = done
+	g.notify(RoomDeleted, r)
+	g.mu.Unlock()
+
+	var err error
+	if remove != nil {
+		err = remove()
+	}
+
+	g.mu.Lock()
+	delete(g.pending, r.Name)
+	g.mu.Unlock()
+	close(done)
+
+	return err
+}
+
+// Subscribe returns a channel receiving the rooms created and deleted from now on, and a function
+// that cancels the subscription and closes the channel.
+func (g *RoomRegistry) Subscribe() (<-chan RegistryEvent, func()) {
+	events := make(chan RegistryEvent, registryEventBufferSize)
+
+	g.mu.Lock()
+	g.subscribers[events] = struct{}{}
+	g.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			g.mu.Lock()
+			delete(g.subscribers, events)
+			g.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// notify sends an event to every subscriber. The caller must hold g.mu for writing.
+func (g *RoomRegistry) notify(t RegistryEventType, r *Room) {
+	for events := range g.subscribers {
+		select {
+		case events <- RegistryEvent{Type: t, Room: r}:
+		default:
+			log.Default().Printf("Registry subscriber is too slow; dropping %s event of room '%s'", t, r.Name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRegistryCreateIfAbsentOnce races many creations of the same rooms and checks each is created
+// exactly once and returned to every caller.
+func TestRegistryCreateIfAbsentOnce(t *testing.T) {
+	g := NewRoomRegistry()
+	const names, callers = 10, 50
+
+	var calls atomic.Int32
+	results := make([][]*Room, names)
+	for i := range results {
+		results[i] = make([]*Room, callers)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < names; i++ {
+		for j := 0; j < callers; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				name := fmt.Sprintf("room-%d", i)
+				r, _, err := g.CreateIfAbsent(name, func() (*Room, error) {
+					calls.Add(1)
+					time.Sleep(time.Millisecond)
+					return NewRoom(name, 0, nil), nil
+				})
+				if err != nil {
+					t.Errorf("creating %s: %v", name, err)
+				}
+				results[i][j] = r
+			}(i, j)
+		}
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != names {
+		t.Errorf("create was called %d times, want %d", got, names)
+	}
+	for i, rooms := range results {
+		for _, r := range rooms {
+			if r != rooms[0] {
+				t.Errorf("room-%d: callers got different rooms", i)
+				break
+			}
+		}
+	}
+	if got := g.Len(); got != names {
+		t.Errorf("got %d rooms, want %d", got, names)
+	}
+	for _, r := range g.List() {
+		r.Stop()
+	}
+}
+
+// TestRegistryCreateFailureReleasesName checks that a failed creation lets the next caller create
+// the room.
+func TestRegistryCreateFailureReleasesName(t *testing.T) {
+	g := NewRoomRegistry()
+
+	failure := errors.New("store unavailable")
+	if _, _, err := g.CreateIfAbsent("a", func() (*Room, error) { return nil, failure }); err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+	if _, ok := g.Get("a"); ok {
+		t.Fatal("failed room was registered")
+	}
+
+	r, created, err := g.CreateIfAbsent("a", func() (*Room, error) { return NewRoom("a", 0, nil), nil })
+	if err != nil || !created {
+		t.Fatalf("got created %v, error %v; want the room created", created, err)
+	}
+	r.Stop()
+}
+
+// TestRegistryCreateDoesNotBlockReaders checks that a slow creation holds up neither lookups nor
+// the creation of other rooms.
+func TestRegistryCreateDoesNotBlockReaders(t *testing.T) {
+	g := NewRoomRegistry()
+	existing, _, _ := g.CreateIfAbsent("existing", func() (*Room, error) { return NewRoom("existing", 0, nil), nil })
+	defer existing.Stop()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go g.CreateIfAbsent("slow", func() (*Room, error) {
+		close(started)
+		<-release
+		return nil, errors.New("cancelled")
+	})
+	<-started
+	defer close(release)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.Get("existing")
+		g.List()
+		g.Len()
+		r, _, _ := g.CreateIfAbsent("other", func() (*Room, error) { return NewRoom("other", 0, nil), nil })
+		r.Stop()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registry was blocked by a slow creation")
+	}
+}
+
+// TestRegistryConcurrentChurn creates, deletes, lists and subscribes concurrently. It is meant to
+// be run with the race detector.
+func TestRegistryConcurrentChurn(t *testing.T) {
+	g := NewRoomRegistry()
+	events, cancel := g.Subscribe()
+	go func() {
+		for range events {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("room-%d", i%5)
+			for j := 0; j < 50; j++ {
+				r, _, err := g.CreateIfAbsent(name, func() (*Room, error) { return NewRoom(name, 0, nil), nil })
+				if err != nil {
+					t.Errorf("creating %s: %v", name, err)
+					return
+				}
+				if g.Delete(r, nil) == nil {
+					r.Stop()
+				}
+				g.List()
+				g.Get(name)
+			}
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, unsubscribe := g.Subscribe()
+				unsubscribe()
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+
+	for _, r := range g.List() {
+		if err := g.Delete(r, nil); err != nil {
+			t.Errorf("deleting %s: %v", r.Name, err)
+		}
+		r.Stop()
+	}
+	if got := g.Len(); got != 0 {
+		t.Errorf("got %d rooms left, want 0", got)
+	}
+}
+
+// TestRegistryDeleteReservesName checks that a room cannot be created under the name of a room
+// being deleted until its removal is over.
+func TestRegistryDeleteReservesName(t *testing.T) {
+	g := NewRoomRegistry()
+	old, _, _ := g.CreateIfAbsent("a", func() (*Room, error) { return NewRoom("a", 0, nil), nil })
+
+	removing := make(chan struct{})
+	release := make(chan struct{})
+	deleted := make(chan error)
+	go func() {
+		deleted <- g.Delete(old, func() error {
+			close(removing)
+			<-release
+			old.Stop()
+			return nil
+		})
+	}()
+	<-removing
+
+	created := make(chan *Room)
+	go func() {
+		r, _, _ := g.CreateIfAbsent("a", func() (*Room, error) { return NewRoom("a", 0, nil), nil })
+		created <- r
+	}()
+
+	select {
+	case <-created:
+		t.Fatal("room was created while the previous one was being removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := g.Get("a"); ok {
+		t.Error("deleted room is still registered")
+	}
+
+	close(release)
+	if err := <-deleted; err != nil {
+		t.Fatalf("deleting: %v", err)
+	}
+	r := <-created
+	if r == old {
+		t.Error("got the deleted room back")
+	}
+	r.Stop()
+}
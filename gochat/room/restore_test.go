@@ -0,0 +1,102 @@
+package room
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// TestRestoreRoomAfterRestart saves a room and its messages, then restores it from the store as
+// the server does on startup, once with each store implementation.
+func TestRestoreRoomAfterRestart(t *testing.T) {
+	stores := []struct {
+		name string
+		// opener returns a function that opens the same store every time it is called, as a
+		// restarted server would.
+		opener func(t *testing.T) func() store.MessageStore
+	}{
+		{name: "bolt", opener: func(t *testing.T) func() store.MessageStore {
+			path := filepath.Join(t.TempDir(), "gochat.db")
+			open := func() store.MessageStore {
+				s, err := store.NewBoltStore(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { s.Close() })
+				return s
+			}
+			return open
+		}},
+		{name: "memory", opener: func(t *testing.T) func() store.MessageStore {
+			// A memory store cannot outlive the process, so the same one is opened again.
+			s := store.NewMemoryStore()
+			return func() store.MessageStore { return s }
+		}},
+	}
+
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			open := tt.opener(t)
+			db := open()
+
+			r := NewRoom("books", 10, db)
+			record := r.Record()
+			record.Topic = "what we read"
+			if err := db.SaveRoom(record); err != nil {
+				t.Fatal(err)
+			}
+			srv := newTestServer(t, r)
+			conn := dial(t, srv, "alice")
+			for _, content := range []string{"first", "second"} {
+				data, err := protocol.Encode(protocol.TypeChat, r.Name, "", &protocol.ChatPayload{Content: content})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitFor(t, 5*time.Second, "the messages to be saved", func() bool { return r.MessageCount() == 2 })
+			r.Stop()
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db = open()
+			records, err := db.Rooms()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("got %d stored rooms, want 1", len(records))
+			}
+			restored, err := RestoreRoom(records[0], db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Stop()
+
+			if got := restored.Info().Topic; got != "what we read" {
+				t.Errorf("got topic %q, want %q", got, "what we read")
+			}
+			if got := restored.MessageCount(); got != 2 {
+				t.Fatalf("got %d messages, want 2", got)
+			}
+			restored.mu.Lock()
+			messages, lastID := restored.Messages, restored.lastID
+			restored.mu.Unlock()
+			for i, want := range []string{"first", "second"} {
+				if messages[i].Content != want || messages[i].ID != uint64(i+1) {
+					t.Errorf("message %d: got %+v, want %q", i+1, messages[i], want)
+				}
+			}
+			if lastID != 2 {
+				t.Errorf("got last ID %d, want 2: new messages would reuse IDs", lastID)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// Permission is an action in a room that is restricted to some roles.
+type Permission int
+
+const (
+	// PermRename allows changing the name of the room.
+	PermRename Permission = iota
+	// PermSetCapacity allows changing the capacity of the room.
+	PermSetCapacity
+	// PermDeleteRoom allows deleting the room.
+	PermDeleteRoom
+	// PermDeleteMessages allows deleting messages written by other users.
+	PermDeleteMessages
+	// PermKick allows disconnecting other users from the room.
+	PermKick
+	// PermBan allows banning other users from the room.
+	PermBan
+	// PermMute allows muting other users in the room.
+	PermMute
+	// PermInvite allows creating and revoking invites to the room.
+	PermInvite
+	// PermManageRoles allows granting and revoking the moderator role.
+	PermManageRoles
+	// PermEditDetails allows changing the topic and description of the room.
+	PermEditDetails
+	// PermArchive allows archiving and reopening the room.
+	PermArchive
+)
+
+// rolePermissions lists what each role may do. Members have no special permissions.
+var rolePermissions = map[models.Role][]Permission{
+	models.RoleOwner:     {PermRename, PermSetCapacity, PermDeleteRoom, PermDeleteMessages, PermKick, PermBan, PermMute, PermInvite, PermManageRoles, PermEditDetails, PermArchive},
+	models.RoleModerator: {PermDeleteMessages, PermKick, PermBan, PermMute, PermInvite, PermEditDetails},
+}
+
+var (
+	ErrForbidden   = errors.New("permission denied")
+	ErrInvalidRole = errors.New("only the moderator and member roles can be granted")
+)
+
+// SetOwner makes username the owner of the room. It does not check permissions and is meant to be
+// called when the room is created, before it is saved.
+func (r *Room) SetOwner(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.owner = username
+	delete(r.roles, username)
+}
+
+// Owner returns the owner of the room, or "" if the room is owned by the server.
+func (r *Room) Owner() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.owner
+}
+
+// Role returns the role of username in the room.
+func (r *Room) Role(username string) models.Role {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.roleLocked(username)
+}
+
+// roleLocked is Role for callers holding r.mu.
+func (r *Room) roleLocked(username string) models.Role {
+	if username != "" && username == r.owner {
+		return models.RoleOwner
+	}
+	if role, ok := r.roles[username]; ok {
+		return role
+	}
+	return models.RoleMember
+}
+
+// Can reports whether username is allowed to perform p in the room.
+func (r *Room) Can(username string, p Permission) bool {
+	for _, allowed := range rolePermissions[r.Role(username)] {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Moderators returns the users holding the moderator role, sorted by name.
+func (r *Room) Moderators() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	moderators := []string{}
+	for username, role := range r.roles {
+		if role == models.RoleModerator {
+			moderators = append(moderators, username)
+		}
+	}
+	sort.Strings(moderators)
+	return moderators
+}
+
+// SetRole grants role to username on behalf of actor, who must be allowed to manage roles. Only
+// the moderator and member roles can be granted; granting member revokes the moderator role. The
+// change is saved and broadcast to the room.
+func (r *Room) SetRole(actor string, username string, role models.Role) error {
+	if role != models.RoleModerator && role != models.RoleMember {
+		return ErrInvalidRole
+	}
+	if !r.Can(actor, PermManageRoles) {
+		return ErrForbidden
+	}
+
+	var err error
+	ok := r.exec(func() {
+		if r.Owner() == username {
+			err = ErrForbidden
+			return
+		}
+
+		err = r.updateRecord(func() func() {
+			previous, had := r.roles[username]
+			if role == models.RoleMember {
+				delete(r.roles, username)
+			} else {
+				r.roles[username] = role
+			}
+			return func() {
+				if had {
+					r.roles[username] = previous
+				} else {
+					delete(r.roles, username)
+				}
+			}
+		})
+		if err != nil {
+			log.Default().Printf("[ %s ] Failed persisting role of %s: %v", r.Name, username, err)
+			return
+		}
+
+		log.Default().Printf("[ %s ] %s made %s a %s", r.Name, actor, username, role)
+		data, encErr := protocol.Encode(protocol.TypeRole, r.Name, "", &protocol.RolePayload{Username: username, Role: string(role)})
+		if encErr != nil {
+			log.Default().Printf("Failed marshalling role event into JSON")
+			return
+		}
+		r.broadcast(data, nil)
+	})
+	if !ok {
+		return ErrRoomStopped
+	}
+
+	return err
+}
+
+// updateRecord applies change to the state of the room under r.mu and saves the room record. If
+// saving fails the change is undone with the function returned by change. It must only be called
+// by the hub.
+func (r *Room) updateRecord(change func() (undo func())) error {
+	r.mu.Lock()
+	undo := change()
+	r.mu.Unlock()
+
+	if r.store == nil {
+		return nil
+	}
+	if err := r.store.SaveRoom(r.Record()); err != nil {
+		r.mu.Lock()
+		undo()
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// restoreRoles loads the owner and roles of a stored room record.
+func (r *Room) restoreRoles(record *store.RoomRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.owner = record.Owner
+	for username, role := range record.Roles {
+		r.roles[username] = role
+	}
+}
+
+// HandleModerators serves /rooms/{name}/moderators. GET lists the moderators of the room; PUT
+// grants the moderator role to the user given by the user form value and DELETE revokes it.
+// Only the owner may grant and revoke roles.
+func (r *Room) HandleModerators(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var role models.Role
+	switch req.Method {
+	case http.MethodGet:
+		responseData, err := json.Marshal(r.Moderators())
+		if err != nil {
+			http.Error(w, "Moderators JSON marshalling failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write(responseData)
+		return
+	case http.MethodPut:
+		role = models.RoleModerator
+	case http.MethodDelete:
+		role = models.RoleMember
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := req.Form.Get("user")
+	if username == "" {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.SetRole(user.Username, username, role); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,16 +2,20 @@ package room
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/auth"
 	models "github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+	"github.com/stefan-chivu/gochat/gochat/store"
 )
 
 const (
@@ -19,173 +23,464 @@ const (
 	messageBufferSize = 256
 )
 
-var upgrader = &websocket.Upgrader{
-	ReadBufferSize:  socketBufferSize,
-	WriteBufferSize: socketBufferSize,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	}}
-
 type Room struct {
 	mu sync.Mutex
 
 	Name string
 
 	// clients holds all current clients in this room.
-	Clients map[*websocket.Conn]string
+	clients map[*websocket.Conn]*client
 
-	// the maximum capacity of a room
+	// the maximum capacity of a room. Zero does not limit the number of connections. It is guarded
+	// by mu.
 	Capacity int
+	// topic, description and archived are the settings changed by Update. All of them are guarded
+	// by mu. See lifecycle.go.
+	topic       string
+	description string
+	archived    bool
+	// direct and group are set on the rooms backing direct and group conversations.
+	direct bool
+	group  bool
+
+	// owner is the user who created the room and roles the roles granted to other users. Both are
+	// guarded by mu. See role.go.
+	owner string
+	roles map[string]models.Role
+	// bans and mutes hold the sanctions imposed in the room, by username. Both are guarded by mu.
+	// See moderation.go.
+	bans  map[string]*models.Sanction
+	mutes map[string]*models.Sanction
+	// visibility decides who can see and join the room; members and invites let users into rooms
+	// that are not public. All of them are guarded by mu. See access.go.
+	visibility   models.Visibility
+	passwordHash string
+	members      map[string]bool
+	invites      map[string]*models.Invite
+	// historyFrom maps the users who may only read part of the history to the ID of the last
+	// message they cannot read. It is guarded by mu.
+	historyFrom map[string]uint64
 
 	Messages []*models.Message
-
-	forward chan *models.Message
+	// lastID is the ID of the newest message in the room.
+	lastID uint64
+
+	// forward, ops, join and leave are the hub's inputs. See run.
+	forward chan *post
+	ops     chan func()
+	join    chan *joinRequest
+	leave   chan *websocket.Conn
+	// quit is closed by Close to terminate the hub; stopped is closed once it has exited.
+	// closeReason is sent to the clients in their close frame.
+	quit        chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	closeReason string
+
+	// typing maps the users currently typing to the time their typing indicator expires. It is
+	// only accessed by the hub.
+	typing map[string]time.Time
+
+	// store persists the room's messages. A nil store keeps history in memory only.
+	store store.MessageStore
+
+	// CheckOrigin, when set, decides which origins may open the websocket of the room. When nil,
+	// only same-origin requests are accepted.
+	CheckOrigin func(r *http.Request) bool
+	// SendPolicy decides what happens to clients that cannot keep up with the room.
+	SendPolicy SendPolicy
+	// SendTimeout is how long a client whose queue is full has to catch up with BlockWithTimeout.
+	SendTimeout time.Duration
+	// OnOccupancy, when set, is called by the hub with the number of connections to the room
+	// every time a client joins or leaves. It must not block.
+	OnOccupancy func(r *Room, clients int)
+	// Presence, when set, is told about every connection to the room and every frame received.
+	Presence PresenceTracker
 }
 
 type RoomInfo struct {
 	Capacity    int
 	ClientCount int
+	Owner       string `json:",omitempty"`
+	Visibility  models.Visibility
+	Topic       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	Archived    bool   `json:",omitempty"`
 }
 
-func NewRoom(name string, capacity int) *Room {
-	return &Room{
+// NewRoom creates a room and starts its hub. Call Stop to shut the room down.
+func NewRoom(name string, capacity int, messageStore store.MessageStore) *Room {
+	r := &Room{
 		Name:     name,
 		Capacity: capacity,
-		Clients:  make(map[*websocket.Conn]string),
+		clients:  make(map[*websocket.Conn]*client),
 		Messages: make([]*models.Message, 0),
-		forward:  make(chan *models.Message),
+		forward:  make(chan *post),
+		ops:      make(chan func()),
+		join:     make(chan *joinRequest),
+		leave:    make(chan *websocket.Conn),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		store:    messageStore,
+		typing:   make(map[string]time.Time),
+		roles:    make(map[string]models.Role),
+		bans:     make(map[string]*models.Sanction),
+		mutes:    make(map[string]*models.Sanction),
+		members:  make(map[string]bool),
+		invites:  make(map[string]*models.Invite),
+
+		historyFrom: make(map[string]uint64),
+
+		visibility: models.VisibilityPublic,
+
+		SendPolicy:  DropOldest,
+		SendTimeout: time.Second,
 	}
+	go r.run()
+
+	return r
 }
 
-func NewPrivateChat(username1 string, username2 string) *Room {
-	chat := NewRoom("Private_"+username1+"_"+username2, 2)
+// RestoreRoom recreates a room from its stored record and loads its message history.
+func RestoreRoom(record *store.RoomRecord, messageStore store.MessageStore) (*Room, error) {
+	r := NewRoom(record.Name, record.Capacity, messageStore)
+	r.direct = record.Direct
+	r.group = record.Group
+	r.restoreRoles(record)
+	r.restoreSanctions(record)
+	r.restoreAccess(record)
+	r.restoreSettings(record)
+
+	messages, err := messageStore.Messages(record.Name)
+	if err != nil {
+		r.Stop()
+		return nil, fmt.Errorf("failed to load messages of room '%s': %v", record.Name, err)
+	}
+	r.mu.Lock()
+	r.Messages = messages
+	for i, msg := range messages {
+		// Messages stored before IDs were introduced are numbered in history order.
+		if msg.ID == 0 {
+			msg.ID = uint64(i + 1)
+		}
+		r.lastID = msg.ID
+	}
+	r.mu.Unlock()
 
-	return chat
+	return r, nil
 }
 
-func (r *Room) broadcast(msg []byte) {
-	for ws := range r.Clients {
-		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Default().Println("Websocket write error: ", err)
+// Record returns the persisted description of the room.
+func (r *Room) Record() *store.RoomRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record := &store.RoomRecord{
+		Name:     r.Name,
+		Capacity: r.Capacity,
+		Owner:    r.owner,
+		Direct:   r.direct,
+		Group:    r.group,
+
+		Topic:       r.topic,
+		Description: r.description,
+		Archived:    r.archived,
+	}
+	if len(r.roles) > 0 {
+		record.Roles = make(map[string]models.Role, len(r.roles))
+		for username, role := range r.roles {
+			record.Roles[username] = role
+		}
+	}
+	record.Bans = activeSanctions(r.bans)
+	record.Mutes = activeSanctions(r.mutes)
+	record.Visibility = r.visibility
+	record.PasswordHash = r.passwordHash
+	if len(r.members) > 0 {
+		record.Members = r.memberList()
+	}
+	if invites := r.activeInvites(); len(invites) > 0 {
+		record.Invites = invites
+	}
+	if len(r.historyFrom) > 0 {
+		record.HistoryFrom = make(map[string]uint64, len(r.historyFrom))
+		for username, id := range r.historyFrom {
+			record.HistoryFrom[username] = id
 		}
 	}
+	return record
+}
+
+// broadcast queues data on the send queue of every client except the given one, which may be
+// nil. Clients that cannot keep up are disconnected according to the room's SendPolicy. Queueing
+// never waits on a client, whatever the policy, so a stuck client delays neither the hub nor the
+// other clients. It must only be called by the hub.
+func (r *Room) broadcast(data []byte, except *client) {
+	r.mu.Lock()
+	clients := make([]*client, 0, len(r.clients))
+	for _, c := range r.clients {
+		if c != except {
+			clients = append(clients, c)
+		}
+	}
+	r.mu.Unlock()
+
+	var slow []*client
+	for _, c := range clients {
+		if !c.enqueue(data, r.SendPolicy, r.SendTimeout) {
+			log.Default().Printf("[ %s ] %s is too slow; disconnecting (policy: %s)", r.Name, c.username, r.SendPolicy)
+			slow = append(slow, c)
+		}
+	}
+
+	for _, c := range slow {
+		r.dropClient(c)
+	}
+}
+
+// sendTo queues data for a single client.
+func (r *Room) sendTo(c *client, data []byte) {
+	if !c.enqueue(data, r.SendPolicy, r.SendTimeout) {
+		log.Default().Printf("[ %s ] %s is too slow; disconnecting (policy: %s)", r.Name, c.username, r.SendPolicy)
+		r.unregister(c.conn)
+	}
 }
 
-func (r *Room) readLoop(ws *websocket.Conn) {
-	layout := "02/01/2006 15:04"
+func (r *Room) readLoop(c *client) {
 	for {
-		_, buff, err := ws.ReadMessage()
+		msgType, buff, err := c.conn.ReadMessage()
 		if err != nil {
 			if err == io.EOF {
 				continue
 			}
 
-			if _, ok := r.Clients[ws]; ok {
+			if r.hasClient(c.conn) {
 				if websocket.IsCloseError(err, websocket.CloseGoingAway) {
-					r.forward <- (&models.Message{
-						Username:  "Server",
-						Content:   r.Clients[ws] + " disconnected",
-						Timestamp: time.Now().Format(layout),
-					})
-
-					r.handleClose(ws, fmt.Sprintf("[ %s ] %s is going away", r.Name, r.Clients[ws]))
+					r.handleClose(c.conn, fmt.Sprintf("[ %s ] %s is going away", r.Name, c.username))
 					break
 				}
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseAbnormalClosure) {
-					r.handleClose(ws, fmt.Sprintf("[ %s ] %s closed unexpectedly", r.Name, r.Clients[ws]))
+					r.handleClose(c.conn, fmt.Sprintf("[ %s ] %s closed unexpectedly", r.Name, c.username))
 					break
 				}
 			}
 
 			log.Default().Println("Websocket read error", err)
+			r.unregister(c.conn)
 			break
 		}
 
-		log.Default().Printf("[ %s ] received message: [ %s : %s ]", r.Name, r.Clients[ws], string(buff))
+		log.Default().Printf("[ %s ] received message: [ %s : %s ]", r.Name, c.username, string(buff))
+		if r.Presence != nil {
+			r.Presence.Touch(c.username)
+		}
+
+		var env *protocol.Envelope
+		if msgType != websocket.TextMessage {
+			err = &protocol.Error{Code: protocol.ErrMalformed, Message: "only text frames are accepted"}
+		} else {
+			env, err = protocol.Decode(buff, r.Name)
+		}
+		if err != nil {
+			var protocolErr *protocol.Error
+			if !errors.As(err, &protocolErr) {
+				protocolErr = &protocol.Error{Code: protocol.ErrMalformed, Message: err.Error()}
+			}
+			r.reject(c, protocolErr)
+			continue
+		}
+
+		switch env.Type {
+		case protocol.TypeChat:
+			chat := env.Chat()
+			if cmd, ok := parseCommand(chat.Content); ok {
+				r.acknowledge(c, env.ID, 0, r.runCommand(c.username, cmd))
+				continue
+			}
+			r.publish(&post{
+				msg: &models.Message{
+					Username: c.username,
+					Content:  chat.Content,
+					Nonce:    chat.Nonce,
+					ParentID: chat.ParentID,
+				},
+				from: c,
+				ref:  env.ID,
+			})
+		case protocol.TypeEdit:
+			edit := env.Edit()
+			_, err := r.EditMessage(c.username, edit.MessageID, edit.Content)
+			r.acknowledge(c, env.ID, edit.MessageID, err)
+		case protocol.TypeDelete:
+			del := env.Delete()
+			_, err := r.DeleteMessage(c.username, del.MessageID)
+			r.acknowledge(c, env.ID, del.MessageID, err)
+		case protocol.TypeReaction:
+			reaction := env.Reaction()
+			err := r.React(c.username, reaction.MessageID, reaction.Emoji, reaction.Remove)
+			r.acknowledge(c, env.ID, reaction.MessageID, err)
+		case protocol.TypeTyping:
+			typing := env.Typing()
+			r.exec(func() { r.setTyping(c.username, typing.Typing) })
+		}
+	}
+}
+
+// acknowledge answers an envelope that changed messageID with an ack, or with an error envelope
+// if the change failed.
+func (r *Room) acknowledge(c *client, ref string, messageID uint64, err error) {
+	if err != nil {
+		r.reject(c, &protocol.Error{Code: messageErrorCode(err), Message: err.Error(), Ref: ref})
+		return
+	}
+
+	data, err := protocol.Encode(protocol.TypeAck, r.Name, ref, &protocol.AckPayload{MessageID: messageID})
+	if err != nil {
+		log.Default().Printf("Failed marshalling ack into JSON")
+		return
+	}
+	r.sendTo(c, data)
+}
+
+// reject answers a malformed or invalid frame with an error envelope.
+func (r *Room) reject(c *client, e *protocol.Error) {
+	log.Default().Printf("[ %s ] rejected frame from %s: %v", r.Name, c.username, e)
 
-		r.forward <- (&models.Message{
-			Username:  r.Clients[ws],
-			Content:   string(buff),
-			Timestamp: time.Now().Format(layout),
-		})
+	data, err := protocol.EncodeError(r.Name, e)
+	if err != nil {
+		log.Default().Printf("Failed marshalling error envelope into JSON")
+		return
 	}
+	r.sendTo(c, data)
 }
 
+// GetClients returns a snapshot of the room's connections and their usernames.
 func (r *Room) GetClients() map[*websocket.Conn]string {
-	return r.Clients
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make(map[*websocket.Conn]string, len(r.clients))
+	for ws, c := range r.clients {
+		clients[ws] = c.username
+	}
+	return clients
+}
+
+// ClientCount returns the number of connections currently in the room.
+func (r *Room) ClientCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.clients)
 }
 
+// Users returns a snapshot of the users connected to the room, sorted by name. Users with several
+// connections are listed once.
+func (r *Room) Users() []string {
+	r.mu.Lock()
+	seen := make(map[string]bool, len(r.clients))
+	users := []string{}
+	for _, c := range r.clients {
+		if !seen[c.username] {
+			seen[c.username] = true
+			users = append(users, c.username)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Strings(users)
+	return users
+}
+
+// MessageCount returns the number of messages in the room's history.
+func (r *Room) MessageCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.Messages)
+}
+
+// full reports whether the room reached its capacity.
+func (r *Room) full() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.Capacity > 0 && len(r.clients) >= r.Capacity
+}
+
+// RemoveClient removes the connection from the room and stops its writer.
 func (r *Room) RemoveClient(ws *websocket.Conn) {
-	delete(r.Clients, ws)
+	r.unregister(ws)
+}
+
+func (r *Room) hasClient(ws *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.clients[ws]
+	return ok
 }
 
 func (r *Room) HandleRoomConnection(w http.ResponseWriter, req *http.Request) {
-	if len(r.Clients) >= r.Capacity {
-		http.Error(w, fmt.Sprintf("Room '%s' is full; Max capacity: %d", r.Name, r.Capacity), http.StatusNotAcceptable)
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
 		return
 	}
 
-	if err := req.ParseForm(); err != nil {
-		http.Error(w, "Parse form failed", http.StatusBadRequest)
+	// Authenticator.RequireUser authenticates the request before upgrading, so unauthenticated
+	// clients get a plain 401.
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	username := user.Username
 
-	username := req.Form.Get("username")
+	if ban := r.Ban(username); ban != nil {
+		http.Error(w, fmt.Sprintf("You are banned from room '%s'", r.Name), http.StatusForbidden)
+		return
+	}
 
-	if strings.Contains(r.Name, "Private") {
-		if !strings.Contains(r.Name, username) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	// Rooms that are not public can also be joined with the password or invite form values;
+	// clients that would rather not put them in the URL can use HandleJoin first.
+	if err := r.Join(username, req.Form.Get("password"), req.Form.Get("invite")); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
 	}
 
-	// TODO better valid username check
-	if username == "" {
-		// error case
-		http.Error(w, "Invalid username", http.StatusBadRequest)
+	if r.full() {
+		http.Error(w, fmt.Sprintf("Room '%s' is full; Max capacity: %d", r.Name, r.Info().Capacity), http.StatusNotAcceptable)
 		return
 	}
 
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  socketBufferSize,
+		WriteBufferSize: socketBufferSize,
+		CheckOrigin:     r.CheckOrigin,
+	}
 	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		log.Default().Print("Websocket upgrade failed:", err)
 		return
 	}
 
-	r.mu.Lock()
-	r.Clients[socket] = username
-	r.mu.Unlock()
+	c := newClient(socket, username)
 
-	log.Default().Println("Connected new client from: " + req.RemoteAddr + "; Username: " + username + "; Room: " + r.Name)
+	if !r.register(c) {
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "room is full"), deadline())
+		socket.Close()
+		return
+	}
 
-	go r.handleRoomMsg()
-	r.readLoop(socket)
-}
+	log.Default().Println("Connected new client from: " + req.RemoteAddr + "; Username: " + username + "; Room: " + r.Name)
 
-func (r *Room) handleRoomMsg() {
-	for {
-		msg := <-r.forward
-		log.Default().Printf("[ %s ] %s : %s", r.Name, msg.Username, msg.Content)
-		r.mu.Lock()
-		r.Messages = append(r.Messages, msg)
-		r.mu.Unlock()
-		//TODO db.syncMsg()
-		msgData, err := json.Marshal(msg)
-		if err != nil {
-			log.Default().Printf("Failed marshalling message into JSON")
-			continue
-		}
-		r.broadcast(msgData)
-	}
+	go c.writeLoop()
+	r.readLoop(c)
 }
 
 func (r *Room) GetRoomUsers(w http.ResponseWriter, req *http.Request) {
-	usernameList := []string{}
-
-	for _, username := range r.Clients {
-		usernameList = append(usernameList, username)
-	}
-	responseData, err := json.Marshal(usernameList)
+	responseData, err := json.Marshal(r.Users())
 
 	if err != nil {
 		http.Error(w, "Room users JSON marshalling failed", http.StatusInternalServerError)
@@ -201,7 +496,21 @@ func (r *Room) GetRoomMessages(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	responseData, err := json.Marshal(r.Messages)
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+
+	query, err := ParseHistoryQuery(req.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user, ok := auth.ContextUser(req.Context()); ok {
+		query.Since = r.HistoryFrom(user.Username)
+	}
+
+	responseData, err := json.Marshal(r.History(query))
 
 	if err != nil {
 		http.Error(w, "Room messages JSON marshalling failed", http.StatusInternalServerError)
@@ -213,5 +522,5 @@ func (r *Room) GetRoomMessages(w http.ResponseWriter, req *http.Request) {
 
 func (r *Room) handleClose(ws *websocket.Conn, message string) {
 	log.Default().Print(message)
-	delete(r.Clients, ws)
+	r.RemoveClient(ws)
 }
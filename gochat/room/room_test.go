@@ -0,0 +1,80 @@
+package room
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	"github.com/stefan-chivu/gochat/gochat/models"
+)
+
+func TestMain(m *testing.M) {
+	// Rooms log every connection and message; keep the test output readable.
+	log.Default().SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the websocket of r. The username query value stands in for the
+// authenticated user.
+func newTestServer(t *testing.T, r *Room) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user := &models.User{Username: req.URL.Query().Get("username")}
+		r.HandleRoomConnection(w, req.WithContext(auth.WithUser(req.Context(), user)))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// dial connects username to the room served by srv.
+func dial(t *testing.T, srv *httptest.Server, username string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?username=" + username
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing as %s: %v", username, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readUntil reads frames from conn until one contains want, failing the test after timeout.
+func readUntil(t *testing.T, conn *websocket.Conn, want string, timeout time.Duration) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(string(data), want) {
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	models "github.com/stefan-chivu/gochat/gochat/models"
+)
+
+// ErrNestedReply is returned when replying to a message that is itself a reply. Threads are a
+// single level deep.
+var ErrNestedReply = errors.New("cannot reply to a reply")
+
+// ThreadPage is a page of the replies of a thread together with the message that started it.
+type ThreadPage struct {
+	Parent *models.Message `json:"parent"`
+	*HistoryPage
+}
+
+// addReply counts a new reply on the thread's parent message. It must only be called by the hub.
+func (r *Room) addReply(parentID uint64) error {
+	r.mu.Lock()
+	i := r.messageIndex(parentID)
+	if i < 0 {
+		r.mu.Unlock()
+		return ErrMessageNotFound
+	}
+	parent := *r.Messages[i]
+	r.mu.Unlock()
+
+	if parent.ParentID != 0 {
+		return ErrNestedReply
+	}
+
+	parent.ReplyCount++
+	if r.store != nil {
+		if err := r.store.UpdateMessage(r.Name, &parent); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting reply count of message %d: %v", r.Name, parentID, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.Messages[i] = &parent
+	r.mu.Unlock()
+
+	return nil
+}
+
+// removeReply uncounts a deleted reply from the thread's parent message. Like addReply it replaces
+// the parent with a changed copy. It must only be called by the hub.
+func (r *Room) removeReply(parentID uint64) {
+	r.mu.Lock()
+	i := r.messageIndex(parentID)
+	if i < 0 || r.Messages[i].ReplyCount == 0 {
+		r.mu.Unlock()
+		return
+	}
+	parent := *r.Messages[i]
+	r.mu.Unlock()
+
+	parent.ReplyCount--
+	if r.store != nil {
+		if err := r.store.UpdateMessage(r.Name, &parent); err != nil {
+			log.Default().Printf("[ %s ] Failed persisting reply count of message %d: %v", r.Name, parentID, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.Messages[i] = &parent
+	r.mu.Unlock()
+}
+
+// Thread returns the parent message and a page of its replies selected by q.
+func (r *Room) Thread(parentID uint64, q *HistoryQuery) (*ThreadPage, error) {
+	r.mu.Lock()
+	i := r.messageIndex(parentID)
+	if i < 0 {
+		r.mu.Unlock()
+		return nil, ErrMessageNotFound
+	}
+	parent := r.Messages[i]
+	r.mu.Unlock()
+
+	if parent.ID <= q.Since {
+		return nil, ErrMessageNotFound
+	}
+	if parent.ParentID != 0 {
+		return nil, ErrNestedReply
+	}
+
+	q.Parent = parentID
+	return &ThreadPage{Parent: parent, HistoryPage: r.History(q)}, nil
+}
+
+// getThread serves GET /rooms/{name}/messages/{id}/thread. It accepts the same pagination
+// parameters as GetRoomMessages.
+func (r *Room) getThread(w http.ResponseWriter, req *http.Request, parentID uint64) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := ParseHistoryQuery(req.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user, ok := auth.ContextUser(req.Context()); ok {
+		query.Since = r.HistoryFrom(user.Username)
+	}
+
+	thread, err := r.Thread(parentID, query)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	responseData, err := json.Marshal(thread)
+	if err != nil {
+		http.Error(w, "Thread JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(responseData)
+}
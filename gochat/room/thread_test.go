@@ -0,0 +1,50 @@
+package room
+
+import (
+	"testing"
+
+	models "github.com/stefan-chivu/gochat/gochat/models"
+)
+
+func TestDeletingReplyUpdatesReplyCount(t *testing.T) {
+	r := NewRoom("threads", 0, nil)
+	defer r.Stop()
+
+	for _, msg := range []*models.Message{
+		{Username: "alice", Content: "question"},
+		{Username: "bob", Content: "first answer", ParentID: 1},
+		{Username: "carol", Content: "second answer", ParentID: 1},
+	} {
+		r.exec(func() { r.handleRoomMsg(&post{msg: msg}) })
+	}
+
+	replyCount := func() int {
+		page, err := r.Thread(1, &HistoryQuery{Limit: 10})
+		if err != nil {
+			t.Fatalf("reading thread: %v", err)
+		}
+		return page.Parent.ReplyCount
+	}
+	if got := replyCount(); got != 2 {
+		t.Fatalf("got %d replies, want 2", got)
+	}
+
+	before, _ := r.Thread(1, &HistoryQuery{Limit: 10})
+	if _, err := r.DeleteMessage("bob", 2); err != nil {
+		t.Fatalf("deleting reply: %v", err)
+	}
+	if got := replyCount(); got != 1 {
+		t.Errorf("got %d replies after deleting one, want 1", got)
+	}
+	if before.Parent.ReplyCount != 2 {
+		t.Error("deleting a reply changed a snapshot of its parent")
+	}
+
+	// Deleting the same reply again fails and does not uncount it twice.
+	if _, err := r.DeleteMessage("bob", 2); err != ErrMessageDeleted {
+		t.Errorf("got %v deleting the reply again, want %v", err, ErrMessageDeleted)
+	}
+	if got := replyCount(); got != 1 {
+		t.Errorf("got %d replies, want 1", got)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+	"github.com/stefan-chivu/gochat/gochat/room"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// handleDirectConversations serves /dms. GET lists the direct and group conversations of the user,
+// newest activity first. POST with a single user form value starts the direct conversation with
+// that user, or returns the existing one; POST with several starts a group conversation with them.
+func (s *Server) handleDirectConversations(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.listDirectConversations(w, user.Username)
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			return
+		}
+		if len(r.Form["user"]) > 1 {
+			s.createGroupConversation(w, r, user.Username)
+		} else {
+			s.createDirectConversation(w, r, user.Username)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listDirectConversations(w http.ResponseWriter, username string) {
+	s.mu.Lock()
+	conversations := []*room.ConversationInfo{}
+	for _, conversation := range s.Conversations {
+		if conversation.HasParticipant(username) {
+			conversations = append(conversations, conversation.Info(username))
+		}
+	}
+	for _, group := range s.Groups {
+		if group.HasParticipant(username) {
+			conversations = append(conversations, group.Info(username))
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(conversations, func(i, j int) bool {
+		a, b := lastActivity(conversations[i]), lastActivity(conversations[j])
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return conversations[i].Name < conversations[j].Name
+	})
+
+	responseData, err := json.Marshal(conversations)
+	if err != nil {
+		http.Error(w, "Conversation list JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(responseData)
+}
+
+// lastActivity returns the time of the last message of a conversation, or the zero time.
+func lastActivity(info *room.ConversationInfo) time.Time {
+	if info.LastMessage == nil {
+		return time.Time{}
+	}
+	return info.LastMessage.Timestamp
+}
+
+// createDirectConversation starts the conversation between username and the user given by the
+// user form value. Creating a conversation that already exists, in either order, returns it.
+func (s *Server) createDirectConversation(w http.ResponseWriter, r *http.Request, username string) {
+	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Create Direct Conversation Request received"))
+
+	other := r.Form.Get("user")
+	if other == username {
+		http.Error(w, room.ErrSelfConversation.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkParticipant(w, other) {
+		return
+	}
+
+	conversation, status, err := s.directConversation(username, other)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	responseData, err := json.Marshal(conversation.Info(username))
+	if err != nil {
+		http.Error(w, "Conversation JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(responseData)
+}
+
+// directConversation returns the conversation between username and other with the status
+// 200 OK, or creates and saves it and returns it with 201 Created. While the conversation is
+// created its name is reserved in pendingConversations, so s.mu is not held while the store is
+// written and concurrent requests for it wait for the first one.
+func (s *Server) directConversation(username string, other string) (*room.DirectConversation, int, error) {
+	name := room.DirectName(username, other)
+	var done chan struct{}
+	for done == nil {
+		s.mu.Lock()
+		if conversation, ok := s.Conversations[name]; ok {
+			s.mu.Unlock()
+			return conversation, http.StatusOK, nil
+		}
+		wait, ok := s.pendingConversations[name]
+		if !ok {
+			done = make(chan struct{})
+			s.pendingConversations[name] = done
+		}
+		s.mu.Unlock()
+
+		if wait != nil {
+			<-wait
+		}
+	}
+
+	conversation, status, err := s.newDirectConversation(username, other)
+
+	s.mu.Lock()
+	delete(s.pendingConversations, name)
+	if err == nil {
+		s.Conversations[name] = conversation
+	}
+	s.mu.Unlock()
+	close(done)
+
+	return conversation, status, err
+}
+
+// newDirectConversation creates and saves the conversation between username and other.
+func (s *Server) newDirectConversation(username string, other string) (*room.DirectConversation, int, error) {
+	conversation, err := room.NewDirectConversation(username, other, s.Store)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	s.configureRoom(conversation.Room)
+
+	if err := s.Store.SaveRoom(conversation.Record()); err != nil {
+		conversation.Stop()
+		s.Config.Log.Error().Err(err).Msgf("Direct conversation '%s' creation failed", conversation.Name)
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to save conversation")
+	}
+
+	s.Config.Log.Info().Msgf("Direct conversation '%s' has been created", conversation.Name)
+	return conversation, http.StatusCreated, nil
+}
+
+// createGroupConversation starts a conversation between username and the users given by the user
+// form values.
+func (s *Server) createGroupConversation(w http.ResponseWriter, r *http.Request, username string) {
+	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Create Group Conversation Request received"))
+
+	participants := r.Form["user"]
+	for _, participant := range participants {
+		if !s.checkParticipant(w, participant) {
+			return
+		}
+	}
+
+	group, err := room.NewGroupConversation(username, participants, s.Store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.configureRoom(group.Room)
+
+	// Group names are random, so unlike direct conversations there is no name to reserve while
+	// the store is written.
+	if err := s.Store.SaveRoom(group.Record()); err != nil {
+		group.Stop()
+		http.Error(w, "Failed to save conversation", http.StatusInternalServerError)
+		s.Config.Log.Error().Err(err).Msgf("Group conversation '%s' creation failed", group.Name)
+		return
+	}
+
+	s.mu.Lock()
+	s.Groups[group.Name] = group
+	s.mu.Unlock()
+	s.Config.Log.Info().Msgf("Group conversation '%s' has been created", group.Name)
+
+	responseData, err := json.Marshal(group.Info(username))
+	if err != nil {
+		http.Error(w, "Conversation JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseData)
+}
+
+// handleParticipants serves /rooms/{name}/participants for a group conversation. Users added with
+// PUT are checked like the participants of new conversations first.
+func (s *Server) handleParticipants(group *room.GroupConversation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Error parsing form data", http.StatusBadRequest)
+				return
+			}
+			if username := r.Form.Get("user"); username != "" && !s.checkParticipant(w, username) {
+				return
+			}
+		}
+		group.HandleParticipants(w, r)
+	}
+}
+
+// checkParticipant checks that a conversation can be started with username, writing the error
+// response if it cannot.
+func (s *Server) checkParticipant(w http.ResponseWriter, username string) bool {
+	if ok, reason := s.isValidUsername(username); !ok {
+		http.Error(w, reason, http.StatusBadRequest)
+		return false
+	}
+	// Users picking their name in dev mode are not registered.
+	if s.Config.InsecureDevMode {
+		return true
+	}
+	if _, err := s.Store.User(username); err == store.ErrUserNotFound {
+		http.Error(w, "User "+username+" does not exist", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to look up user "+username, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/room"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+// slowStore is a memory store that holds up the saving of conversations until release is closed.
+type slowStore struct {
+	store.Store
+	saving  chan struct{}
+	release chan struct{}
+	saves   atomic.Int32
+}
+
+func (s *slowStore) SaveRoom(record *store.RoomRecord) error {
+	if strings.HasPrefix(record.Name, room.DirectPrefix) {
+		if s.saves.Add(1) == 1 {
+			close(s.saving)
+		}
+		<-s.release
+	}
+	return s.Store.SaveRoom(record)
+}
+
+// TestCreateDirectConversationConcurrently starts the same conversation from many requests while
+// the store is slow, and checks that it is created once and that the server is not held up.
+func TestCreateDirectConversationConcurrently(t *testing.T) {
+	db := &slowStore{Store: store.NewMemoryStore(), saving: make(chan struct{}), release: make(chan struct{})}
+	s, srv := startTestServer(t, db)
+	for _, username := range []string{testUsername, "bob"} {
+		if _, err := s.Auth.RegisterUser(username, testPassword); err != nil {
+			t.Fatalf("registering %s: %v", username, err)
+		}
+	}
+	session := testCredentials(t, srv)[1]
+
+	const requests = 5
+	statuses := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/dms", strings.NewReader(url.Values{"user": {"bob"}}.Encode()))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			session.apply(req)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	select {
+	case <-db.saving:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the conversation was never saved")
+	}
+	found := make(chan struct{})
+	go func() {
+		s.findRoom("Global")
+		close(found)
+	}()
+	select {
+	case <-found:
+	case <-time.After(time.Second):
+		t.Error("the server was held up while the conversation was saved")
+	}
+
+	close(db.release)
+	wg.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("got status %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("the conversation was created %d times, want 1", created)
+	}
+	if got := db.saves.Load(); got != 1 {
+		t.Errorf("the conversation was saved %d times, want 1", got)
+	}
+	<-found
+}
+
+// TestAddParticipantMustExist checks that only registered users can be added to a group
+// conversation.
+func TestAddParticipantMustExist(t *testing.T) {
+	s, srv := startTestServer(t, store.NewMemoryStore())
+	for _, username := range []string{testUsername, "bob", "carol", "dave"} {
+		if _, err := s.Auth.RegisterUser(username, testPassword); err != nil {
+			t.Fatalf("registering %s: %v", username, err)
+		}
+	}
+	session := testCredentials(t, srv)[1]
+
+	do := func(method, path string, form url.Values) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.apply(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/dms", url.Values{"user": {"bob", "carol"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating the group: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	var group room.ConversationInfo
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		t.Fatal(err)
+	}
+	path := "/rooms/" + url.PathEscape(group.Name) + "/participants"
+
+	for _, tt := range []struct {
+		user string
+		want int
+	}{
+		{user: "ghost", want: http.StatusNotFound},
+		{user: "dave", want: http.StatusNoContent},
+	} {
+		resp := do(http.MethodPut, path, url.Values{"user": {tt.user}})
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("adding %s: got status %d, want %d", tt.user, resp.StatusCode, tt.want)
+		}
+	}
+
+	r, _ := s.findRoom(group.Name)
+	if got := r.Members(); len(got) != 4 {
+		t.Errorf("got participants %v, want alice, bob, carol and dave", got)
+	}
+}
@@ -3,55 +3,43 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/auth"
 	"github.com/stefan-chivu/gochat/gochat/room"
+	"github.com/stefan-chivu/gochat/gochat/store"
 )
 
 const (
 	socketBufferSize  = 1024
 	messageBufferSize = 256
-)
 
-var upgrader = &websocket.Upgrader{
-	ReadBufferSize:  socketBufferSize,
-	WriteBufferSize: socketBufferSize,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	}}
+	// minRoomCapacity and maxRoomCapacity bound the capacity of the rooms created by users.
+	minRoomCapacity = 5
+	maxRoomCapacity = 20
+)
 
+// home serves the lobby websocket. See Lobby.
 func (s *Server) home(w http.ResponseWriter, req *http.Request) {
-	ws, err := Upgrade(w, req)
-
-	if err != nil {
-		fmt.Fprintf(w, "%+V\n", err)
-	}
-
-	if err := req.ParseForm(); err != nil {
-		http.Error(w, "Parse form failed", http.StatusBadRequest)
+	user, ok := auth.ContextUser(req.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	username := user.Username
 
-	username := req.Form.Get("username")
-
-	// TODO better valid username check
-	if username == "" {
-		// error case
-		http.Error(w, "Invalid username", http.StatusBadRequest)
+	ws, err := s.Upgrade(w, req)
+	if err != nil {
 		return
 	}
 
-	s.mu.Lock()
-	s.Clients[ws] = username
-	s.mu.Unlock()
-
 	log.Default().Println("Connected new client from: " + req.RemoteAddr + "; Username: " + username)
-	// go s.writer(ws)
-	s.reader(ws)
+	s.Lobby.Serve(ws, username)
 }
 
 func (s *Server) getUserMessages(w http.ResponseWriter, r *http.Request) {
@@ -60,13 +48,15 @@ func (s *Server) getUserMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	socket, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Default().Print("Websocket upgrade failed:", err)
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	user := s.Clients[socket]
-	messageList := s.Messages[user]
+
+	s.mu.Lock()
+	messageList := s.Messages[user.Username]
+	s.mu.Unlock()
 	responseData, err := json.Marshal(messageList)
 
 	if err != nil {
@@ -77,8 +67,8 @@ func (s *Server) getUserMessages(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseData)
 }
 
-func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+func (s *Server) Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return ws, err
@@ -86,39 +76,6 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	return ws, nil
 }
 
-func (s *Server) reader(conn *websocket.Conn) {
-	for {
-		messageType, buff, err := conn.ReadMessage()
-		if err != nil {
-			if err == io.EOF {
-				continue
-			}
-
-			if _, ok := s.Clients[conn]; ok {
-				if websocket.IsCloseError(err, websocket.CloseGoingAway) {
-					s.handleClose(conn, fmt.Sprintf("%s is going away", s.Clients[conn]))
-					break
-				}
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseAbnormalClosure) {
-					s.handleClose(conn, fmt.Sprintf("%s closed unexpectedly", s.Clients[conn]))
-					break
-				}
-				if websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
-					s.handleClose(conn, fmt.Sprintf("%s closed abnormally", s.Clients[conn]))
-					break
-				}
-			}
-
-			log.Default().Println("Websocket read error", err)
-			break
-		}
-		if err := conn.WriteMessage(messageType, buff); err != nil {
-			log.Println(err)
-			continue
-		}
-	}
-}
-
 // func (s *Server) writer(conn *websocket.Conn) {
 // 	for {
 // 		messageType, buff, err := conn.NextReader()
@@ -142,32 +99,15 @@ func (s *Server) reader(conn *websocket.Conn) {
 // 	}
 // }
 
-func (s *Server) ServeWs(w http.ResponseWriter, req *http.Request) {
-	ws, err := Upgrade(w, req)
-
-	if err != nil {
-		fmt.Fprintf(w, "%+V\n", err)
-	}
-
-	if err := req.ParseForm(); err != nil {
-		http.Error(w, "Parse form failed", http.StatusBadRequest)
-		return
-	}
-
-	username := req.Form.Get("username")
-
-	// TODO better valid username check
-	if username == "" {
-		// error case
-		http.Error(w, "Invalid username", http.StatusBadRequest)
+// health reports that the server is up. It is public so load balancers can probe it.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	s.mu.Lock()
-	s.Clients[ws] = username
-	s.mu.Unlock()
-
-	log.Default().Println("Connected new client from: " + req.RemoteAddr + "; Username: " + username)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
 }
 
 func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
@@ -176,10 +116,10 @@ func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Users with several connections are listed once.
 	userList := []string{}
-
-	for _, v := range s.Clients {
-		userList = append(userList, v)
+	for _, p := range s.Presence.Connected() {
+		userList = append(userList, p.Username)
 	}
 
 	responseData, err := json.Marshal(userList)
@@ -192,7 +132,8 @@ func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseData)
 }
 
-func (s *Server) createPrivateChat(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createRoom(w http.ResponseWriter, r *http.Request) {
+
 	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Create Room Request received"))
 
 	if r.Method != http.MethodPost {
@@ -207,73 +148,295 @@ func (s *Server) createPrivateChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username1 := r.Form.Get("username1")
+	roomName := r.Form.Get("roomName")
 
-	if ok, reason := s.isValidUsername(username1); !ok {
+	if ok, reason := isValidRoomName(roomName); !ok {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
 
-	username2 := r.Form.Get("username2")
-
-	if ok, reason := s.isValidUsername(username2); !ok {
+	capacity, ok, reason := parseRoomCapacity(r.Form.Get("capacity"))
+	if !ok {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
 
-	chat := room.NewPrivateChat(username1, username2)
+	visibility, err := room.ParseVisibility(r.Form.Get("visibility"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusBadRequest
+	_, created, err := s.Rooms.CreateIfAbsent(roomName, func() (*room.Room, error) {
+		newRoom := s.newRoom(roomName, capacity)
+		if err := newRoom.SetVisibility(visibility, r.Form.Get("password")); err != nil {
+			newRoom.Stop()
+			return nil, err
+		}
+		if user, ok := auth.ContextUser(r.Context()); ok {
+			newRoom.SetOwner(user.Username)
+		}
 
-	s.Rooms[chat.Name] = chat
+		if err := s.Store.SaveRoom(newRoom.Record()); err != nil {
+			newRoom.Stop()
+			status = http.StatusInternalServerError
+			s.Config.Log.Error().Err(err).Msgf("Room '%s' creation failed", roomName)
+			return nil, fmt.Errorf("failed to save room %s", roomName)
+		}
+		return newRoom, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !created {
+		http.Error(w, "A room named "+roomName+" already exists", http.StatusNotAcceptable)
+		s.Config.Log.Error().Msgf("Room '%s' creation failed. Already exists.", roomName)
+		return
+	}
+
+	s.Config.Log.Info().Msgf("Room '" + roomName + "' has been created")
 }
 
-func (s *Server) createRoom(w http.ResponseWriter, r *http.Request) {
+// handleRoom serves /rooms/{name}: PATCH changes the settings of the room, DELETE deletes it and
+// anything else connects to it.
+func (s *Server) handleRoom(rm *room.Room) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPatch:
+			s.updateRoom(w, r, rm)
+		case http.MethodDelete:
+			s.deleteRoom(w, r, rm)
+		default:
+			rm.HandleRoomConnection(w, r)
+		}
+	}
+}
 
-	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Create Room Request received"))
+// updateRoom renames the room if the name form value is set and changes the settings given by the
+// capacity, topic, description and archived form values. Missing values are left unchanged.
+func (s *Server) updateRoom(w http.ResponseWriter, r *http.Request, rm *room.Room) {
+	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Update Room Request received"))
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form data", http.StatusBadRequest)
 		return
 	}
 
-	// Parse the form data from the POST request
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	roomName := r.Form.Get("roomName")
+	name := rm.Name
+	if r.Form.Has("name") && r.Form.Get("name") != rm.Name {
+		name = r.Form.Get("name")
+		if !rm.Can(user.Username, room.PermRename) {
+			http.Error(w, room.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		if ok, reason := isValidRoomName(name); !ok {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
+	}
 
-	if ok, reason := isValidRoomName(roomName); !ok {
-		http.Error(w, reason, http.StatusBadRequest)
+	update := &room.RoomUpdate{}
+	if r.Form.Has("capacity") {
+		capacity, ok, reason := parseRoomCapacity(r.Form.Get("capacity"))
+		if !ok {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
+		update.Capacity = &capacity
+	}
+	if r.Form.Has("topic") {
+		topic := r.Form.Get("topic")
+		update.Topic = &topic
+	}
+	if r.Form.Has("description") {
+		description := r.Form.Get("description")
+		update.Description = &description
+	}
+	if r.Form.Has("archived") {
+		archived, err := strconv.ParseBool(r.Form.Get("archived"))
+		if err != nil {
+			http.Error(w, "Invalid archived parameter", http.StatusBadRequest)
+			return
+		}
+		update.Archived = &archived
+	}
+
+	// Every change is checked before any is applied. The room is then renamed first, since that is
+	// the change most likely to fail, and the settings are applied to the renamed room. Should
+	// saving them fail, the rename is undone so that the request changes nothing.
+	if err := rm.CheckUpdate(user.Username, update); err != nil {
+		http.Error(w, err.Error(), roomErrorStatus(err))
 		return
 	}
 
-	capacity, err := strconv.Atoi(r.Form.Get("capacity"))
+	oldName := rm.Name
+	if name != oldName {
+		renamed, status, err := s.renameRoom(rm, name)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		rm = renamed
+	}
 
+	if err := rm.Update(user.Username, update); err != nil {
+		if rm.Name != oldName {
+			if _, _, undoErr := s.renameRoom(rm, oldName); undoErr != nil {
+				s.Config.Log.Error().Err(undoErr).Msgf("Room '%s' could not be renamed back to '%s'", rm.Name, oldName)
+			}
+		}
+		http.Error(w, err.Error(), roomErrorStatus(err))
+		return
+	}
+	if rm.Name != oldName {
+		s.Config.Log.Info().Msgf("Room '%s' has been renamed to '%s' by %s", oldName, rm.Name, user.Username)
+		w.Header().Set("Location", "/rooms/"+url.PathEscape(rm.Name))
+	}
+	s.Config.Log.Info().Msgf("Room '%s' has been updated by %s", rm.Name, user.Username)
+
+	responseData, err := json.Marshal(rm.Info())
 	if err != nil {
-		http.Error(w, "Invalid room capacity parameter", http.StatusBadRequest)
+		http.Error(w, "Room JSON marshalling failed", http.StatusInternalServerError)
 		return
 	}
 
-	if capacity < 5 || capacity > 20 {
-		http.Error(w, "Room capacity must be a value between 5 and 20", http.StatusBadRequest)
+	w.Write(responseData)
+}
+
+// renameRoom moves rm and its history to name. Both names stay reserved in the registry while the
+// room moves, so neither can be taken meanwhile. The clients of rm are disconnected and have to
+// join the renamed room. On failure it returns the HTTP status to answer with.
+func (s *Server) renameRoom(rm *room.Room, name string) (*room.Room, int, error) {
+	status := http.StatusInternalServerError
+	renamed, created, err := s.Rooms.CreateIfAbsent(name, func() (*room.Room, error) {
+		var renamed *room.Room
+		err := s.Rooms.Delete(rm, func() error {
+			// The hub is stopped first so that nothing is saved under the old name afterwards.
+			record := rm.Record()
+			rm.Close("room renamed to " + name)
+			if err := s.Store.RenameRoom(rm.Name, name); err != nil {
+				return err
+			}
+
+			record.Name = name
+			r, err := room.RestoreRoom(record, s.Store)
+			if err != nil {
+				return err
+			}
+			s.configureRoom(r)
+			renamed = r
+			return nil
+		})
+		if err == room.ErrRoomNotFound {
+			status = http.StatusNotFound
+			return nil, fmt.Errorf("room %s no longer exists", rm.Name)
+		}
+		if err == store.ErrRoomExists {
+			status = http.StatusNotAcceptable
+			s.reopenRoom(rm)
+			return nil, fmt.Errorf("A room named %s already exists", name)
+		}
+		if err != nil {
+			s.Config.Log.Error().Err(err).Msgf("Renaming room '%s' to '%s' failed", rm.Name, name)
+			s.reopenRoom(rm)
+			return nil, fmt.Errorf("failed to rename room %s", rm.Name)
+		}
+		return renamed, nil
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	if !created {
+		return nil, http.StatusNotAcceptable, fmt.Errorf("A room named %s already exists", name)
+	}
+
+	return renamed, http.StatusOK, nil
+}
+
+// reopenRoom registers rm again from its stored record after a failed rename stopped it.
+func (s *Server) reopenRoom(rm *room.Room) {
+	_, _, err := s.Rooms.CreateIfAbsent(rm.Name, func() (*room.Room, error) {
+		r, err := room.RestoreRoom(rm.Record(), s.Store)
+		if err != nil {
+			return nil, err
+		}
+		s.configureRoom(r)
+		return r, nil
+	})
+	if err != nil {
+		s.Config.Log.Error().Err(err).Msgf("Room '%s' could not be reopened", rm.Name)
+	}
+}
+
+// deleteRoom deletes the room and its history, disconnecting everybody in it. Only the owner may
+// delete a room.
+func (s *Server) deleteRoom(w http.ResponseWriter, r *http.Request, rm *room.Room) {
+	s.Config.Log.Info().Msg(httpReqLogMsg(r, "Delete Room Request received"))
+
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !rm.Can(user.Username, room.PermDeleteRoom) {
+		http.Error(w, room.ErrForbidden.Error(), http.StatusForbidden)
 		return
 	}
 
-	if _, ok := s.Rooms[roomName]; ok {
-		http.Error(w, "A room named "+roomName+" already exists", http.StatusNotAcceptable)
-		s.Config.Log.Error().Msgf("Room '%s' creation failed. Already exists.", roomName)
+	// The hub is stopped before the room is removed from the store so that nothing saves it again.
+	// The registry keeps the name reserved until then, so a new room cannot take it and lose its
+	// records to the store deletion.
+	err := s.Rooms.Delete(rm, func() error {
+		rm.Close("room deleted")
+		return s.Store.DeleteRoom(rm.Name)
+	})
+	if err == room.ErrRoomNotFound {
+		http.NotFound(w, r)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to delete room "+rm.Name, http.StatusInternalServerError)
+		s.Config.Log.Error().Err(err).Msgf("Room '%s' deletion failed", rm.Name)
+		return
+	}
+	s.Config.Log.Info().Msgf("Room '%s' has been deleted by %s", rm.Name, user.Username)
 
-	s.Rooms[roomName] = room.NewRoom(roomName, capacity)
-	http.HandleFunc("/rooms/"+roomName, s.Rooms[roomName].HandleRoomConnection)
-	http.HandleFunc("/rooms/"+roomName+"/messages", s.Rooms[roomName].GetRoomMessages)
-	http.HandleFunc("/rooms/"+roomName+"/users", s.Rooms[roomName].GetRoomUsers)
-	s.Config.Log.Info().Msgf("Room '" + roomName + "' has been created")
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// TODO: save room data to DB
+// parseRoomCapacity parses the capacity of a room created or updated by a user.
+func parseRoomCapacity(value string) (int, bool, string) {
+	capacity, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false, "Invalid room capacity parameter"
+	}
+
+	if capacity < minRoomCapacity || capacity > maxRoomCapacity {
+		return 0, false, fmt.Sprintf("Room capacity must be a value between %d and %d", minRoomCapacity, maxRoomCapacity)
+	}
+
+	return capacity, true, ""
+}
+
+// roomErrorStatus maps an error returned by a room to an HTTP status.
+func roomErrorStatus(err error) int {
+	switch err {
+	case room.ErrForbidden:
+		return http.StatusForbidden
+	case room.ErrRoomStopped:
+		return http.StatusNotFound
+	case room.ErrInvalidCapacity, room.ErrTopicTooLong, room.ErrDescriptionTooLong:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
 
 func (s *Server) getRooms(w http.ResponseWriter, r *http.Request) {
@@ -282,12 +445,19 @@ func (s *Server) getRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	roomData := map[string]*room.RoomInfo{}
-	for name, r := range s.Rooms {
-		roomData[name] = &room.RoomInfo{
-			Capacity:    r.Capacity,
-			ClientCount: len(r.Clients),
+	for _, r := range s.Rooms.List() {
+		// Invite-only rooms are hidden from users who are not members.
+		if !r.CanSee(user.Username) {
+			continue
 		}
+		roomData[r.Name] = r.Info()
 	}
 	responseData, err := json.Marshal(roomData)
 
@@ -312,6 +482,17 @@ func isValidRoomName(roomName string) (bool, string) {
 		return false, "Room name should not exceed 20 characters"
 	}
 
+	for _, prefix := range []string{"Private_", room.DirectPrefix, room.GroupPrefix} {
+		if strings.HasPrefix(roomName, prefix) {
+			return false, "Room names starting with '" + prefix + "' are reserved for private conversations"
+		}
+	}
+
+	// These would be shadowed by the /rooms/create route or cleaned out of room URLs.
+	if roomName == "create" || roomName == "." || roomName == ".." {
+		return false, "Room name '" + roomName + "' is reserved"
+	}
+
 	// TODO: think of more constraints
 
 	return true, ""
@@ -330,8 +511,3 @@ func (s *Server) isValidUsername(username string) (bool, string) {
 
 	return true, ""
 }
-
-func (s *Server) handleClose(ws *websocket.Conn, message string) {
-	log.Default().Print(message)
-	delete(s.Clients, ws)
-}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestUpdateRoomChangesNothingOnFailure renames a room along with an invalid setting and checks
+// that neither change is applied.
+func TestUpdateRoomChangesNothingOnFailure(t *testing.T) {
+	srv := newTestServer(t)
+	session := testCredentials(t, srv)[1]
+
+	do := func(method, path string, form url.Values) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.apply(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := do(http.MethodPost, "/rooms/create", url.Values{
+		"roomName":   {"books"},
+		"capacity":   {"10"},
+		"visibility": {"public"},
+	}); got != http.StatusOK {
+		t.Fatalf("creating the room: got status %d", got)
+	}
+
+	if got := do(http.MethodPatch, "/rooms/books", url.Values{
+		"name":  {"novels"},
+		"topic": {strings.Repeat("x", 1000)},
+	}); got != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := do(http.MethodGet, "/rooms/books/users", nil); got != http.StatusOK {
+		t.Errorf("the room was renamed: GET /rooms/books/users answered %d", got)
+	}
+	if got := do(http.MethodGet, "/rooms/novels/users", nil); got != http.StatusNotFound {
+		t.Errorf("GET /rooms/novels/users answered %d, want %d", got, http.StatusNotFound)
+	}
+
+	if got := do(http.MethodPatch, "/rooms/books", url.Values{"name": {"novels"}, "topic": {"fiction"}}); got != http.StatusOK {
+		t.Fatalf("got status %d, want %d", got, http.StatusOK)
+	}
+	if got := do(http.MethodGet, "/rooms/novels/users", nil); got != http.StatusOK {
+		t.Errorf("the room was not renamed: GET /rooms/novels/users answered %d", got)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stefan-chivu/gochat/gochat/presence"
+	"github.com/stefan-chivu/gochat/gochat/protocol"
+	"github.com/stefan-chivu/gochat/gochat/room"
+)
+
+const (
+	// lobbyWriteWait is the time allowed to write a single event to a lobby socket.
+	lobbyWriteWait = 10 * time.Second
+	// lobbySendBufferSize is how many events a lobby client may fall behind before it is
+	// disconnected.
+	lobbySendBufferSize = 64
+)
+
+// lobbyClient is a websocket connection to the lobby. Events are queued on send and written by
+// writeLoop, so a slow socket only delays its own events.
+type lobbyClient struct {
+	conn     *websocket.Conn
+	username string
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *lobbyClient) writeLoop() {
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(lobbyWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Default().Println("Lobby write error: ", err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close stops the writer goroutine and closes the connection. It is safe to call more than once.
+func (c *lobbyClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Lobby pushes the changes of the room directory and of who is online to every client connected
+// to the root websocket. Clients only ever see the rooms they are allowed to see.
+type Lobby struct {
+	mu sync.Mutex
+
+	clients map[*lobbyClient]struct{}
+
+	rooms       *room.RoomRegistry
+	presence    *presence.Tracker
+	unsubscribe func()
+}
+
+// NewLobby creates a lobby announcing the rooms created in and deleted from rooms and the presence
+// changes of tracker. Lobby connections count towards the presence of their users. Call Close to
+// stop it.
+func NewLobby(rooms *room.RoomRegistry, tracker *presence.Tracker) *Lobby {
+	events, unsubscribe := rooms.Subscribe()
+	l := &Lobby{
+		clients:     make(map[*lobbyClient]struct{}),
+		rooms:       rooms,
+		presence:    tracker,
+		unsubscribe: unsubscribe,
+	}
+	tracker.OnChange(l.announcePresence)
+	go l.run(events)
+
+	return l
+}
+
+// run forwards registry events to the clients until the subscription is cancelled.
+func (l *Lobby) run(events <-chan room.RegistryEvent) {
+	for event := range events {
+		r := event.Room
+		switch event.Type {
+		case room.RoomCreated:
+			l.broadcast(protocol.TypeRoomCreated, r.Name, r.Info(), r.CanSee)
+		case room.RoomDeleted:
+			l.broadcast(protocol.TypeRoomDeleted, r.Name, struct{}{}, r.CanSee)
+		}
+	}
+}
+
+// RoomOccupancy announces the number of connections to r. It is meant to be set as the
+// OnOccupancy hook of the rooms of the registry; rooms that are not registered, such as
+// conversations, are ignored.
+func (l *Lobby) RoomOccupancy(r *room.Room, clients int) {
+	if registered, ok := l.rooms.Get(r.Name); !ok || registered != r {
+		return
+	}
+	l.broadcast(protocol.TypeRoomOccupancy, r.Name, &protocol.OccupancyPayload{ClientCount: clients}, r.CanSee)
+}
+
+// Serve adds the connection of username to the lobby and blocks until it is closed. Clients do not
+// send anything to the lobby; their frames are read only to notice when they leave.
+func (l *Lobby) Serve(conn *websocket.Conn, username string) {
+	c := &lobbyClient{
+		conn:     conn,
+		username: username,
+		send:     make(chan []byte, lobbySendBufferSize),
+		done:     make(chan struct{}),
+	}
+
+	l.mu.Lock()
+	l.clients[c] = struct{}{}
+	l.mu.Unlock()
+
+	log.Default().Printf("[ lobby ] %s connected", username)
+	l.presence.Connect(username, "")
+
+	go c.writeLoop()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	c.close()
+
+	l.mu.Lock()
+	delete(l.clients, c)
+	l.mu.Unlock()
+
+	log.Default().Printf("[ lobby ] %s disconnected", username)
+	l.presence.Disconnect(username, "")
+}
+
+// announcePresence tells everybody that a user went online, away or offline.
+func (l *Lobby) announcePresence(p *presence.Presence) {
+	payload := &protocol.PresencePayload{Username: p.Username, Status: string(p.Status)}
+	if p.Status != presence.Online {
+		payload.LastSeen = &p.LastSeen
+	}
+	l.broadcast(protocol.TypePresence, "", payload, nil)
+}
+
+// broadcast queues an event for every client whose user passes visible, or for everybody if
+// visible is nil. Clients that fall too far behind are disconnected. visible is called without
+// l.mu held, so it may take room locks.
+func (l *Lobby) broadcast(t protocol.Type, roomName string, payload interface{}, visible func(username string) bool) {
+	data, err := protocol.Encode(t, roomName, "", payload)
+	if err != nil {
+		log.Default().Printf("Failed marshalling %s event into JSON", t)
+		return
+	}
+
+	l.mu.Lock()
+	clients := make([]*lobbyClient, 0, len(l.clients))
+	for c := range l.clients {
+		clients = append(clients, c)
+	}
+	l.mu.Unlock()
+
+	for _, c := range clients {
+		if visible != nil && !visible(c.username) {
+			continue
+		}
+		select {
+		case c.send <- data:
+		case <-c.done:
+		default:
+			log.Default().Printf("[ lobby ] %s is too slow; disconnecting", c.username)
+			c.close()
+		}
+	}
+}
+
+// Close stops announcing room changes and disconnects every client.
+func (l *Lobby) Close() {
+	l.unsubscribe()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for c := range l.clients {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(lobbyWriteWait))
+		c.close()
+	}
+}
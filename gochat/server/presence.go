@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/stefan-chivu/gochat/gochat/auth"
+)
+
+// getUserPresence serves /users/{name} and /users/{name}/rooms. The first returns the presence of
+// the user, the second only the rooms they are connected to. Rooms the caller cannot see are left
+// out of both.
+func (s *Server) getUserPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := auth.ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	escapedName, path, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/users/"), "/")
+	username, err := url.PathUnescape(escapedName)
+	if err != nil || username == "" || (path != "" && path != "rooms") {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := s.Presence.Get(username)
+	p.Rooms = s.visibleRooms(p.Rooms, user.Username)
+
+	var response interface{} = p
+	if path == "rooms" {
+		response = p.Rooms
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "User presence JSON marshalling failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(responseData)
+}
+
+// visibleRooms returns the names of the rooms that username is allowed to see. Rooms that no longer
+// exist are dropped.
+func (s *Server) visibleRooms(names []string, username string) []string {
+	visible := []string{}
+	for _, name := range names {
+		if r, _ := s.findRoom(name); r != nil && r.CanSee(username) {
+			visible = append(visible, name)
+		}
+	}
+	return visible
+}
@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -14,7 +17,9 @@ import (
 	"github.com/stefan-chivu/gochat/gochat/auth"
 	"github.com/stefan-chivu/gochat/gochat/configuration"
 	"github.com/stefan-chivu/gochat/gochat/models"
+	"github.com/stefan-chivu/gochat/gochat/presence"
 	"github.com/stefan-chivu/gochat/gochat/room"
+	"github.com/stefan-chivu/gochat/gochat/store"
 )
 
 var shutdown os.Signal = syscall.SIGUSR1
@@ -45,50 +50,260 @@ type Server struct {
 
 	Config *configuration.ServerConfig
 
+	// Mux routes every request of the server. See setupRoutes.
 	Mux *http.ServeMux
 	// Rooms represent the rooms currently available on the server
-	Rooms map[string]*room.Room
+	Rooms *room.RoomRegistry
+	// Conversations are the direct conversations between two users, by room name
+	Conversations map[string]*room.DirectConversation
+	// Groups are the group conversations, by room name
+	Groups map[string]*room.GroupConversation
+	// pendingConversations reserves the names of the direct conversations being created. The
+	// channel is closed once the creation is over.
+	pendingConversations map[string]chan struct{}
 
-	Clients map[*websocket.Conn]string
+	// Lobby pushes room directory and online user changes to the clients of the root websocket
+	Lobby *Lobby
+	// Presence follows the users connected to the lobby and to rooms
+	Presence *presence.Tracker
 	// TODO Replace string with User at some point
 	Messages map[string]([]*models.Message)
+	// Store persists rooms, their message history and user accounts
+	Store store.Store
+	// Auth authenticates the users of the server
+	Auth *auth.Authenticator
+
+	// sendPolicy is the slow client policy applied to every room
+	sendPolicy room.SendPolicy
+	// upgrader upgrades the lobby websocket connections
+	upgrader *websocket.Upgrader
 }
 
-func NewServer(config *configuration.ServerConfig) *Server {
-	// TODO: Implement database fetch for existing rooms
-	// rooms := db.getRooms()
+func NewServer(config *configuration.ServerConfig, db store.Store) (*Server, error) {
+	authenticator, err := auth.NewAuthenticator(config, db, db)
+	if err != nil {
+		return nil, err
+	}
+	if config.InsecureDevMode {
+		config.Log.Warn().Msg("Insecure dev mode enabled; clients can connect as any username")
+	}
+
+	sendPolicy, err := room.ParseSendPolicy(config.SlowClientPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Config:        config,
+		Mux:           http.NewServeMux(),
+		Rooms:         room.NewRoomRegistry(),
+		Conversations: make(map[string]*room.DirectConversation),
+		Groups:        make(map[string]*room.GroupConversation),
+		Messages:      make(map[string][]*models.Message),
+		Store:         db,
+		Auth:          authenticator,
+		sendPolicy:    sendPolicy,
 
-	auth.NewCookieStore()
+		pendingConversations: make(map[string]chan struct{}),
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  socketBufferSize,
+			WriteBufferSize: socketBufferSize,
+			CheckOrigin:     authenticator.CheckOrigin,
+		},
+	}
+	s.Presence = presence.NewTracker(config.AwayAfter)
+	s.Lobby = NewLobby(s.Rooms, s.Presence)
 
-	rooms := make(map[string]*room.Room)
+	records, err := db.Rooms()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rooms: %v", err)
+	}
 
-	if len(rooms) == 0 {
-		rooms["Global"] = room.NewRoom("Global", 50)
-		http.HandleFunc("/rooms/Global", rooms["Global"].HandleRoomConnection)
-		// http.HandleFunc("/rooms/Global", rooms["Global"].ServeWs)
-		http.HandleFunc("/rooms/Global/messages", rooms["Global"].GetRoomMessages)
+	for _, record := range records {
+		if record.Direct {
+			conversation, err := room.RestoreDirectConversation(record, db)
+			if err != nil {
+				return nil, err
+			}
+			s.configureRoom(conversation.Room)
+			s.Conversations[conversation.Name] = conversation
+			continue
+		}
+		if record.Group {
+			group, err := room.RestoreGroupConversation(record, db)
+			if err != nil {
+				return nil, err
+			}
+			s.configureRoom(group.Room)
+			s.Groups[group.Name] = group
+			continue
+		}
+
+		r, _, err := s.Rooms.CreateIfAbsent(record.Name, func() (*room.Room, error) {
+			r, err := room.RestoreRoom(record, db)
+			if err != nil {
+				return nil, err
+			}
+			s.configureRoom(r)
+			return r, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		config.Log.Info().Msgf("Room '%s' restored with %d messages", r.Name, r.MessageCount())
+	}
+
+	_, _, err = s.Rooms.CreateIfAbsent("Global", func() (*room.Room, error) {
+		global := s.newRoom("Global", 50)
+		if err := db.SaveRoom(global.Record()); err != nil {
+			global.Stop()
+			return nil, fmt.Errorf("failed to save room 'Global': %v", err)
+		}
+		return global, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	messages := make(map[string][]*models.Message)
-	return &Server{
-		Config:   config,
-		Rooms:    rooms,
-		Messages: messages,
-		Clients:  make(map[*websocket.Conn]string),
+	s.setupRoutes(s.Mux)
+
+	return s, nil
+}
+
+// newRoom creates a room backed by the server's store and configured from the server config.
+func (s *Server) newRoom(name string, capacity int) *room.Room {
+	r := room.NewRoom(name, capacity, s.Store)
+	s.configureRoom(r)
+	return r
+}
+
+func (s *Server) configureRoom(r *room.Room) {
+	r.CheckOrigin = s.Auth.CheckOrigin
+	r.SendPolicy = s.sendPolicy
+	r.SendTimeout = s.Config.SlowClientTimeout
+	r.OnOccupancy = s.Lobby.RoomOccupancy
+	r.Presence = s.Presence
+}
+
+// findRoom returns the room, direct conversation or group conversation named name, or nil if
+// there is none. isRoom reports whether it is a room of the registry.
+func (s *Server) findRoom(name string) (r *room.Room, isRoom bool) {
+	r, isRoom = s.Rooms.Get(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conversation, ok := s.Conversations[name]; ok {
+		r = conversation.Room
 	}
+	if group, ok := s.Groups[name]; ok {
+		r = group.Room
+	}
+	return r, isRoom
+}
+
+// routeRoom serves /rooms/{name} and everything under it. The name is the first segment of the
+// escaped path, so rooms whose names contain '/' or other reserved characters are reached by
+// URL-encoding them. Unknown rooms get a 404.
+func (s *Server) routeRoom(w http.ResponseWriter, req *http.Request) {
+	escapedName, path, found := strings.Cut(strings.TrimPrefix(req.URL.EscapedPath(), "/rooms/"), "/")
+	if found {
+		path = "/" + path
+	}
+
+	name, err := url.PathUnescape(escapedName)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	handler := s.roomRoute(name, path)
+	if handler == nil {
+		http.NotFound(w, req)
+		return
+	}
+	handler(w, req)
+}
+
+// roomRoute returns the handler of path, relative to /rooms/{name}, for the room currently named
+// name, or nil if there is no such room or it does not serve path. Every room route requires an
+// authenticated user, and reading a room that is not public requires being one of its members.
+func (s *Server) roomRoute(name string, path string) http.HandlerFunc {
+	r, isRoom := s.findRoom(name)
+	if r == nil {
+		return nil
+	}
+
+	if strings.HasPrefix(path, "/messages/") {
+		return r.RequireMember(r.HandleMessage)
+	}
+
+	switch path {
+	case "":
+		if isRoom {
+			return s.handleRoom(r)
+		}
+		return r.HandleRoomConnection
+	case "/messages":
+		return r.RequireMember(r.GetRoomMessages)
+	case "/users":
+		return r.RequireMember(r.GetRoomUsers)
+	case "/join":
+		return r.HandleJoin
+	case "/invites":
+		return r.HandleInvites
+	case "/moderators":
+		return r.HandleModerators
+	case "/kick":
+		return r.HandleKick
+	case "/bans":
+		return r.HandleBans
+	case "/mutes":
+		return r.HandleMutes
+	case "/participants":
+		s.mu.Lock()
+		group, isGroup := s.Groups[name]
+		s.mu.Unlock()
+		if isGroup {
+			return s.handleParticipants(group)
+		}
+	}
+	return nil
 }
 
 func (s *Server) setupRoutes(mux *http.ServeMux) {
-	http.HandleFunc("/chat/create", s.createPrivateChat)
-	http.HandleFunc("/rooms/create", s.createRoom)
-	http.HandleFunc("/rooms", s.getRooms)
-	http.HandleFunc("/users/login", auth.Login)
-	http.HandleFunc("/users", s.getUsers)
-	// http.HandleFunc("/users/register", auth.)
-	http.HandleFunc("/messages", s.getUserMessages)
-
-	http.HandleFunc("/", s.home)
-	// http.HandleFunc("/ws", serveWs)
+	// Public routes: logging in, registering and health checks.
+	mux.HandleFunc("/users/login", s.Auth.Login)
+	mux.HandleFunc("/users/logout", s.Auth.Logout)
+	mux.HandleFunc("/users/register", s.Auth.Register)
+	mux.HandleFunc("/auth/token", s.Auth.Token)
+	mux.HandleFunc("/auth/revoke", s.Auth.Revoke)
+	mux.HandleFunc("/health", s.health)
+
+	// Everything else requires an authenticated user.
+	mux.HandleFunc("/dms", s.Auth.RequireUserFunc(s.handleDirectConversations))
+	mux.HandleFunc("/rooms/create", s.Auth.RequireUserFunc(s.createRoom))
+	mux.HandleFunc("/rooms", s.Auth.RequireUserFunc(s.getRooms))
+	mux.HandleFunc("/rooms/", s.Auth.RequireUserFunc(s.routeRoom))
+	mux.HandleFunc("/users", s.Auth.RequireUserFunc(s.getUsers))
+	mux.HandleFunc("/users/", s.Auth.RequireUserFunc(s.getUserPresence))
+	mux.HandleFunc("/messages", s.Auth.RequireUserFunc(s.getUserMessages))
+
+	mux.HandleFunc("/", s.Auth.RequireUserFunc(s.home))
+	// mux.HandleFunc("/ws", serveWs)
+}
+
+// Handler returns the handler serving every route of the server behind the CORS middleware. It
+// uses neither the default mux nor any state shared between servers, so servers can be run side by
+// side, e.g. with httptest.
+func (s *Server) Handler() http.Handler {
+	c := cors.New(cors.Options{
+		AllowOriginFunc:  s.Auth.AllowedOrigin,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowCredentials: true,
+	})
+
+	return c.Handler(s.Mux)
 }
 
 func (s *Server) StartServer(opts *StartOpts) error {
@@ -97,16 +312,7 @@ func (s *Server) StartServer(opts *StartOpts) error {
 		// TODO: Enable TLS
 		s.Config.Log.Info().Msg("Received TLS Certs")
 	}
-	s.Mux = http.NewServeMux()
-
-	s.setupRoutes(s.Mux)
-
-	c := cors.Default()
-
-	// Wrap the mux with the CORS middleware
-	handler := c.Handler(http.DefaultServeMux)
-
-	server := &http.Server{Addr: s.Config.ServerListenAddress, Handler: handler}
+	server := &http.Server{Addr: s.Config.ServerListenAddress, Handler: s.Handler()}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
@@ -122,14 +328,31 @@ func (s *Server) StartServer(opts *StartOpts) error {
 	signal := <-stop
 	log.Printf("Shutting down server ... ")
 
-	for _, room := range s.Rooms {
-		clients := room.GetClients()
-		for ws, username := range clients {
-			ws.Close()
-			room.RemoveClient(ws)
+	for _, room := range s.Rooms.List() {
+		for _, username := range room.GetClients() {
 			s.Config.Log.Info().Msgf("Disconnected user %s", username)
 		}
+		room.Stop()
+	}
+	s.mu.Lock()
+	conversations := make([]*room.DirectConversation, 0, len(s.Conversations))
+	for _, conversation := range s.Conversations {
+		conversations = append(conversations, conversation)
+	}
+	groups := make([]*room.GroupConversation, 0, len(s.Groups))
+	for _, group := range s.Groups {
+		groups = append(groups, group)
+	}
+	s.mu.Unlock()
+
+	for _, conversation := range conversations {
+		conversation.Stop()
+	}
+	for _, group := range groups {
+		group.Stop()
 	}
+	s.Lobby.Close()
+	s.Presence.Stop()
 
 	server.Shutdown(context.TODO())
 	if signal == shutdown {
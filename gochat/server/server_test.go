@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stefan-chivu/gochat/gochat/configuration"
+	"github.com/stefan-chivu/gochat/gochat/store"
+)
+
+const (
+	testUsername = "alice"
+	testPassword = "correct horse battery"
+)
+
+func TestMain(m *testing.M) {
+	// Rooms and the lobby log every request; keep the test output readable.
+	log.Default().SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer starts a server backed by a memory store with a registered test user.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s, srv := startTestServer(t, store.NewMemoryStore())
+	if _, err := s.Auth.RegisterUser(testUsername, testPassword); err != nil {
+		t.Fatalf("registering %s: %v", testUsername, err)
+	}
+	return srv
+}
+
+// startTestServer starts a server backed by db.
+func startTestServer(t *testing.T, db store.Store) (*Server, *httptest.Server) {
+	t.Helper()
+
+	config := configuration.NewDefaultServerConfig()
+	config.Log = zerolog.Nop()
+	config.SessionMaxAge = time.Hour
+	config.AccessTokenTTL = time.Minute
+	config.RefreshTokenTTL = time.Hour
+	config.SlowClientPolicy = "drop-oldest"
+
+	s, err := NewServer(config, db)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Lobby.Close()
+		s.Presence.Stop()
+		for _, r := range s.Rooms.List() {
+			r.Stop()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, conversation := range s.Conversations {
+			conversation.Stop()
+		}
+		for _, group := range s.Groups {
+			group.Stop()
+		}
+	})
+
+	return s, srv
+}
+
+// post sends form to path and fails the test unless the answer has the status want.
+func post(t *testing.T, srv *httptest.Server, path string, form url.Values, want int) *http.Response {
+	t.Helper()
+
+	resp, err := http.PostForm(srv.URL+path, form)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	if resp.StatusCode != want {
+		t.Fatalf("POST %s: got status %d, want %d", path, resp.StatusCode, want)
+	}
+	return resp
+}
+
+// credentials are the ways a request can identify its user. Each sets up a request.
+type credentials struct {
+	name string
+	// authenticated tells whether the credentials should be accepted by RequireUser.
+	authenticated bool
+	apply         func(req *http.Request)
+}
+
+// testCredentials logs the test user in with a session cookie and with tokens, and returns every
+// kind of credentials the routes are tested with.
+func testCredentials(t *testing.T, srv *httptest.Server) []credentials {
+	t.Helper()
+
+	login := post(t, srv, "/users/login", url.Values{"username": {testUsername}, "password": {testPassword}}, http.StatusOK)
+	login.Body.Close()
+	cookies := login.Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("login did not set a session cookie")
+	}
+
+	resp := post(t, srv, "/auth/token", url.Values{
+		"grant_type": {"password"},
+		"username":   {testUsername},
+		"password":   {testPassword},
+	}, http.StatusOK)
+	defer resp.Body.Close()
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatalf("decoding tokens: %v", err)
+	}
+
+	return []credentials{
+		{name: "none", apply: func(*http.Request) {}},
+		{name: "session cookie", authenticated: true, apply: func(req *http.Request) {
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+		}},
+		{name: "access token", authenticated: true, apply: func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		}},
+		{name: "refresh token as bearer", apply: func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+tokens.RefreshToken)
+		}},
+	}
+}
+
+// TestRouteAuthentication checks every route with each kind of credentials. Public routes answer
+// the same whoever asks; protected routes answer 401 unless the user is authenticated.
+func TestRouteAuthentication(t *testing.T) {
+	srv := newTestServer(t)
+	creds := testCredentials(t, srv)
+
+	routes := []struct {
+		method string
+		path   string
+		public bool
+		// want is the status of a request by an authenticated user, or by anybody for public
+		// routes. The requests carry no form values, so some are rejected after authentication.
+		want int
+	}{
+		{method: http.MethodPost, path: "/users/login", public: true, want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/users/logout", public: true, want: http.StatusNoContent},
+		{method: http.MethodPost, path: "/users/register", public: true, want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/auth/token", public: true, want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/auth/revoke", public: true, want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/health", public: true, want: http.StatusOK},
+
+		{method: http.MethodGet, path: "/dms", want: http.StatusOK},
+		{method: http.MethodPost, path: "/dms", want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/rooms/create", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/rooms", want: http.StatusOK},
+		{method: http.MethodGet, path: "/rooms/Global/messages", want: http.StatusOK},
+		{method: http.MethodGet, path: "/rooms/Global/users", want: http.StatusOK},
+		{method: http.MethodGet, path: "/rooms/Global/moderators", want: http.StatusOK},
+		{method: http.MethodGet, path: "/rooms/Global/messages/1", want: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, path: "/rooms/Global/join", want: http.StatusNoContent},
+		{method: http.MethodGet, path: "/rooms/Global/invites", want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/rooms/Global/kick", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/rooms/Global/bans", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/rooms/Global/mutes", want: http.StatusForbidden},
+		// Only group conversations have participants.
+		{method: http.MethodGet, path: "/rooms/Global/participants", want: http.StatusNotFound},
+		{method: http.MethodPatch, path: "/rooms/Global?topic=news", want: http.StatusForbidden},
+		{method: http.MethodDelete, path: "/rooms/Global", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/rooms/missing", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/users", want: http.StatusOK},
+		{method: http.MethodGet, path: "/users/alice", want: http.StatusOK},
+		{method: http.MethodGet, path: "/users/alice/rooms", want: http.StatusOK},
+		{method: http.MethodGet, path: "/messages", want: http.StatusOK},
+		// The websockets refuse plain requests once the user is authenticated.
+		{method: http.MethodGet, path: "/rooms/Global", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/", want: http.StatusBadRequest},
+	}
+
+	for _, route := range routes {
+		for _, cred := range creds {
+			t.Run(route.method+" "+route.path+" with "+cred.name, func(t *testing.T) {
+				req, err := http.NewRequest(route.method, srv.URL+route.path, strings.NewReader(""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				cred.apply(req)
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+
+				want := route.want
+				if !route.public && !cred.authenticated {
+					want = http.StatusUnauthorized
+				}
+				if resp.StatusCode != want {
+					t.Errorf("got status %d, want %d", resp.StatusCode, want)
+				}
+				if want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+					t.Error("401 answer without a WWW-Authenticate header")
+				}
+			})
+		}
+	}
+}
+
+// TestServersSideBySide checks that servers do not share accounts or sessions.
+func TestServersSideBySide(t *testing.T) {
+	first := newTestServer(t)
+	login := post(t, first, "/users/login", url.Values{"username": {testUsername}, "password": {testPassword}}, http.StatusOK)
+	login.Body.Close()
+
+	_, second := startTestServer(t, store.NewMemoryStore())
+
+	// The user registered on the first server is unknown to the second.
+	resp := post(t, second, "/users/login", url.Values{"username": {testUsername}, "password": {testPassword}}, http.StatusUnauthorized)
+	resp.Body.Close()
+
+	// The second server has its own session keys, so it rejects the first one's cookies.
+	req, err := http.NewRequest(http.MethodGet, second.URL+"/rooms", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range login.Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with the first server's session, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// The first server still accepts them.
+	req.URL, _ = url.Parse(first.URL + "/rooms")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d from the first server, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	roomsBucket    = []byte("rooms")
+	messagesBucket = []byte("messages")
+	usersBucket    = []byte("users")
+	revokedBucket  = []byte("revoked_tokens")
+	// expiriesBucket indexes the revoked token IDs by expiry, so the expired ones can be pruned
+	// without scanning every revocation.
+	expiriesBucket = []byte("revoked_token_expiries")
+)
+
+// BoltStore is a Store backed by an embedded bbolt database file.
+//
+// Room records are kept in the "rooms" bucket keyed by room name. Each room has its own
+// sub-bucket under "messages" where messages are keyed by their big-endian ID, so iterating a
+// room's bucket yields its history in order. Users are kept in the "users" bucket keyed by
+// username and revoked token IDs in the "revoked_tokens" bucket, mapped to their expiry. The
+// "revoked_token_expiries" bucket holds the same revocations keyed by expiry then ID, so the
+// expired ones are found with a range scan.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database at '%s': %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{roomsBucket, messagesBucket, usersBucket, revokedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(expiriesBucket) != nil {
+			return nil
+		}
+
+		// Databases created before the expiry index have their revocations indexed once.
+		expiries, err := tx.CreateBucket(expiriesBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(revokedBucket).ForEach(func(k, v []byte) error {
+			var expiresAt time.Time
+			if err := expiresAt.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			return expiries.Put(expiryKey(expiresAt, string(k)), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database buckets: %v", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) SaveRoom(room *RoomRecord) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(room.Name)); err != nil {
+			return err
+		}
+		return tx.Bucket(roomsBucket).Put([]byte(room.Name), data)
+	})
+}
+
+func (s *BoltStore) Rooms() ([]*RoomRecord, error) {
+	rooms := []*RoomRecord{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(_, v []byte) error {
+			var record RoomRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			rooms = append(rooms, &record)
+			return nil
+		})
+	})
+
+	return rooms, err
+}
+
+func (s *BoltStore) DeleteRoom(room string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket(roomsBucket)
+		if rooms.Get([]byte(room)) == nil {
+			return ErrRoomNotFound
+		}
+		if err := rooms.Delete([]byte(room)); err != nil {
+			return err
+		}
+
+		err := tx.Bucket(messagesBucket).DeleteBucket([]byte(room))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *BoltStore) RenameRoom(room string, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket(roomsBucket)
+		data := rooms.Get([]byte(room))
+		if data == nil {
+			return ErrRoomNotFound
+		}
+		if rooms.Get([]byte(name)) != nil {
+			return ErrRoomExists
+		}
+
+		var record RoomRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		record.Name = name
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		if err := rooms.Put([]byte(name), data); err != nil {
+			return err
+		}
+		if err := rooms.Delete([]byte(room)); err != nil {
+			return err
+		}
+
+		// Bolt cannot rename buckets, so the messages are copied to a new one.
+		messages := tx.Bucket(messagesBucket)
+		if err := messages.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		renamed, err := messages.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		old := messages.Bucket([]byte(room))
+		if old == nil {
+			return nil
+		}
+		if err := old.ForEach(func(k, v []byte) error { return renamed.Put(k, v) }); err != nil {
+			return err
+		}
+		return messages.DeleteBucket([]byte(room))
+	})
+}
+
+func (s *BoltStore) AppendMessage(room string, msg *models.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(room))
+		if bucket == nil {
+			return ErrRoomNotFound
+		}
+
+		return bucket.Put(messageKey(msg.ID), data)
+	})
+}
+
+func (s *BoltStore) UpdateMessage(room string, msg *models.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(room))
+		if bucket == nil {
+			return ErrRoomNotFound
+		}
+		if bucket.Get(messageKey(msg.ID)) == nil {
+			return ErrMessageNotFound
+		}
+
+		return bucket.Put(messageKey(msg.ID), data)
+	})
+}
+
+func (s *BoltStore) Messages(room string) ([]*models.Message, error) {
+	messages := []*models.Message{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket).Bucket([]byte(room))
+		if bucket == nil {
+			return ErrRoomNotFound
+		}
+
+		return bucket.ForEach(func(_, v []byte) error {
+			var msg models.Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			messages = append(messages, &msg)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (s *BoltStore) CreateUser(user *models.User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket.Get([]byte(user.Username)) != nil {
+			return ErrUserExists
+		}
+		return bucket.Put([]byte(user.Username), data)
+	})
+}
+
+func (s *BoltStore) User(username string) (*models.User, error) {
+	var user models.User
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(username))
+		if data == nil {
+			return ErrUserNotFound
+		}
+		return json.Unmarshal(data, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *BoltStore) RevokeToken(id string, expiresAt time.Time) error {
+	expiry, err := expiresAt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(revokedBucket)
+		expiries := tx.Bucket(expiriesBucket)
+
+		// Forget revocations of tokens that have expired on their own. The index is sorted by
+		// expiry, so only the expired entries are visited.
+		var expired [][]byte
+		now := expiryKey(time.Now(), "")
+		c := expiries.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, now) < 0; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := expiries.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if err := bucket.Put([]byte(id), expiry); err != nil {
+			return err
+		}
+		return expiries.Put(expiryKey(expiresAt, id), nil)
+	})
+}
+
+func (s *BoltStore) IsRevoked(id string) (bool, error) {
+	var revoked bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(revokedBucket).Get([]byte(id)) != nil
+		return nil
+	})
+
+	return revoked, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// expiryKey is the key of a revoked token in the expiry index: its big-endian expiry in Unix
+// nanoseconds followed by its ID.
+func expiryKey(expiresAt time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(expiresAt.UnixNano()))
+	return append(key, id...)
+}
+
+func messageKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+)
+
+// MemoryStore is a Store that keeps everything in memory. Its contents are lost when
+// the process exits, so it is meant for tests and throwaway instances.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	rooms    map[string]*RoomRecord
+	order    []string
+	messages map[string][]*models.Message
+	users    map[string]*models.User
+	revoked  map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:    make(map[string]*RoomRecord),
+		messages: make(map[string][]*models.Message),
+		users:    make(map[string]*models.User),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) SaveRoom(room *RoomRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room.Name]; !ok {
+		s.order = append(s.order, room.Name)
+	}
+	s.rooms[room.Name] = copyRecord(room)
+
+	return nil
+}
+
+func (s *MemoryStore) Rooms() ([]*RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]*RoomRecord, 0, len(s.order))
+	for _, name := range s.order {
+		rooms = append(rooms, copyRecord(s.rooms[name]))
+	}
+
+	return rooms, nil
+}
+
+func (s *MemoryStore) DeleteRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return ErrRoomNotFound
+	}
+	delete(s.rooms, room)
+	delete(s.messages, room)
+	for i, name := range s.order {
+		if name == room {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RenameRoom(room string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.rooms[room]
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if _, ok := s.rooms[name]; ok {
+		return ErrRoomExists
+	}
+	record.Name = name
+	s.rooms[name] = record
+	delete(s.rooms, room)
+	if messages, ok := s.messages[room]; ok {
+		s.messages[name] = messages
+		delete(s.messages, room)
+	}
+	for i, stored := range s.order {
+		if stored == room {
+			s.order[i] = name
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AppendMessage(room string, msg *models.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return ErrRoomNotFound
+	}
+	s.messages[room] = append(s.messages[room], msg)
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateMessage(room string, msg *models.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return ErrRoomNotFound
+	}
+	for i, stored := range s.messages[room] {
+		if stored.ID == msg.ID {
+			s.messages[room][i] = msg
+			return nil
+		}
+	}
+
+	return ErrMessageNotFound
+}
+
+func (s *MemoryStore) Messages(room string) ([]*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	messages := make([]*models.Message, len(s.messages[room]))
+	copy(messages, s.messages[room])
+
+	return messages, nil
+}
+
+func (s *MemoryStore) CreateUser(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	record := *user
+	s.users[user.Username] = &record
+
+	return nil
+}
+
+func (s *MemoryStore) User(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	record := *user
+
+	return &record, nil
+}
+
+func (s *MemoryStore) RevokeToken(id string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for revoked, expiry := range s.revoked {
+		if now.After(expiry) {
+			delete(s.revoked, revoked)
+		}
+	}
+	s.revoked[id] = expiresAt
+
+	return nil
+}
+
+func (s *MemoryStore) IsRevoked(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revoked[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
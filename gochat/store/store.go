@@ -0,0 +1,144 @@
+// Package store contains the persistence layer used to keep rooms, their message history, user
+// accounts and token revocations across server restarts.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+)
+
+var (
+	// ErrRoomNotFound is returned when an operation references a room the store does not know about.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomExists is returned when renaming a room to the name of another stored room.
+	ErrRoomExists = errors.New("a room with that name already exists")
+	// ErrMessageNotFound is returned when an update references a message the store does not know about.
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrUserExists is returned when creating a user whose username is already taken.
+	ErrUserExists = errors.New("username is already taken")
+	// ErrUserNotFound is returned when looking up a user that is not registered.
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// RoomRecord is the persisted description of a room, used to recreate it at startup.
+type RoomRecord struct {
+	Name     string `json:"name"`
+	Capacity int    `json:"capacity"`
+	// Topic and Description are shown to users browsing the room list.
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Archived rooms keep their history readable but accept no new messages.
+	Archived bool `json:"archived,omitempty"`
+	// Direct and Group mark the rooms backing direct and group conversations.
+	Direct bool `json:"direct,omitempty"`
+	Group  bool `json:"group,omitempty"`
+	// Owner is the user who created the room. Rooms created by the server have no owner.
+	Owner string `json:"owner,omitempty"`
+	// Roles holds the roles granted in the room other than the owner's. Users without an entry
+	// are members.
+	Roles map[string]models.Role `json:"roles,omitempty"`
+	// Bans and Mutes hold the sanctions in effect in the room, by username.
+	Bans  map[string]*models.Sanction `json:"bans,omitempty"`
+	Mutes map[string]*models.Sanction `json:"mutes,omitempty"`
+	// Visibility decides who can see and join the room. Records without one were stored before
+	// visibility was introduced.
+	Visibility models.Visibility `json:"visibility,omitempty"`
+	// PasswordHash is the bcrypt hash of the password of password protected rooms.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Members are the users who joined a room that is not public, sorted by name.
+	Members []string `json:"members,omitempty"`
+	// Invites are the unexpired invites to the room.
+	Invites []*models.Invite `json:"invites,omitempty"`
+	// HistoryFrom maps the members who joined without access to the earlier history to the ID of
+	// the last message they cannot read.
+	HistoryFrom map[string]uint64 `json:"history_from,omitempty"`
+}
+
+// copyRecord returns a copy of record that shares no mutable state with it. Sanctions are shared
+// since they are never changed.
+func copyRecord(record *RoomRecord) *RoomRecord {
+	c := *record
+	if record.Roles != nil {
+		c.Roles = make(map[string]models.Role, len(record.Roles))
+		for username, role := range record.Roles {
+			c.Roles[username] = role
+		}
+	}
+	c.Bans = copySanctions(record.Bans)
+	c.Mutes = copySanctions(record.Mutes)
+	if record.Members != nil {
+		c.Members = append([]string{}, record.Members...)
+	}
+	if record.HistoryFrom != nil {
+		c.HistoryFrom = make(map[string]uint64, len(record.HistoryFrom))
+		for username, id := range record.HistoryFrom {
+			c.HistoryFrom[username] = id
+		}
+	}
+	if record.Invites != nil {
+		c.Invites = make([]*models.Invite, len(record.Invites))
+		for i, invite := range record.Invites {
+			inviteCopy := *invite
+			c.Invites[i] = &inviteCopy
+		}
+	}
+	return &c
+}
+
+func copySanctions(sanctions map[string]*models.Sanction) map[string]*models.Sanction {
+	if sanctions == nil {
+		return nil
+	}
+	c := make(map[string]*models.Sanction, len(sanctions))
+	for username, sanction := range sanctions {
+		c[username] = sanction
+	}
+	return c
+}
+
+// MessageStore persists rooms and their message history.
+type MessageStore interface {
+	// SaveRoom creates or updates the record of a room.
+	SaveRoom(room *RoomRecord) error
+	// Rooms returns every stored room record.
+	Rooms() ([]*RoomRecord, error)
+	// DeleteRoom removes the record and the message history of a room. Deleting a room that does
+	// not exist fails with ErrRoomNotFound.
+	DeleteRoom(room string) error
+	// RenameRoom moves the record and the message history of a room to a new name. It fails with
+	// ErrRoomNotFound if the room does not exist and with ErrRoomExists if the name is taken.
+	RenameRoom(room string, name string) error
+	// AppendMessage adds a message to the end of the room's history.
+	AppendMessage(room string, msg *models.Message) error
+	// UpdateMessage replaces the stored message that has the same ID as msg.
+	UpdateMessage(room string, msg *models.Message) error
+	// Messages returns the full message history of a room, oldest first.
+	Messages(room string) ([]*models.Message, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// UserStore persists registered user accounts.
+type UserStore interface {
+	// CreateUser stores a new user. It fails with ErrUserExists if the username is taken.
+	CreateUser(user *models.User) error
+	// User returns the user registered with username or ErrUserNotFound.
+	User(username string) (*models.User, error)
+}
+
+// TokenStore persists the IDs of revoked tokens until they expire.
+type TokenStore interface {
+	// RevokeToken adds the token ID to the revocation list until expiresAt.
+	RevokeToken(id string, expiresAt time.Time) error
+	// IsRevoked reports whether the token ID is on the revocation list.
+	IsRevoked(id string) (bool, error)
+}
+
+// Store is a backend that persists messages, users and revoked tokens.
+type Store interface {
+	MessageStore
+	UserStore
+	TokenStore
+}
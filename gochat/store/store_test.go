@@ -0,0 +1,261 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stefan-chivu/gochat/gochat/models"
+)
+
+// backend opens a store for a test. Reopening it stands in for a server restart: the bolt store
+// is closed and opened again from its file, while the memory store is kept as is since it
+// cannot outlive the process.
+type backend struct {
+	name   string
+	open   func(t *testing.T) Store
+	reopen func(t *testing.T, s Store) Store
+}
+
+func backends() []backend {
+	return []backend{
+		{
+			name: "bolt",
+			open: func(t *testing.T) Store {
+				s, err := NewBoltStore(filepath.Join(t.TempDir(), "gochat.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { s.Close() })
+				return s
+			},
+			reopen: func(t *testing.T, s Store) Store {
+				path := s.(*BoltStore).db.Path()
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+				reopened, err := NewBoltStore(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { reopened.Close() })
+				return reopened
+			},
+		},
+		{
+			name:   "memory",
+			open:   func(*testing.T) Store { return NewMemoryStore() },
+			reopen: func(_ *testing.T, s Store) Store { return s },
+		},
+	}
+}
+
+// forEachBackend runs test against every store implementation.
+func forEachBackend(t *testing.T, test func(t *testing.T, b backend)) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) { test(t, b) })
+	}
+}
+
+func testRecord(name string) *RoomRecord {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	return &RoomRecord{
+		Name:        name,
+		Capacity:    10,
+		Topic:       "books",
+		Description: "What we read",
+		Owner:       "alice",
+		Roles:       map[string]models.Role{"bob": models.RoleModerator},
+		Bans:        map[string]*models.Sanction{"mallory": {By: "alice", Reason: "spam", At: expiry.Add(-time.Hour), Until: &expiry}},
+		Visibility:  models.VisibilityInvite,
+		Members:     []string{"alice", "bob"},
+		HistoryFrom: map[string]uint64{"bob": 3},
+	}
+}
+
+func TestRoomRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		want := testRecord("books")
+		if err := s.SaveRoom(want); err != nil {
+			t.Fatal(err)
+		}
+		s = b.reopen(t, s)
+
+		rooms, err := s.Rooms()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 {
+			t.Fatalf("got %d rooms, want 1", len(rooms))
+		}
+		if !reflect.DeepEqual(rooms[0], want) {
+			t.Errorf("got %+v, want %+v", rooms[0], want)
+		}
+	})
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		if err := s.AppendMessage("missing", &models.Message{ID: 1}); err != ErrRoomNotFound {
+			t.Errorf("appending to a missing room: got %v, want %v", err, ErrRoomNotFound)
+		}
+		if err := s.SaveRoom(testRecord("books")); err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for i, content := range []string{"first", "second", "third"} {
+			msg := &models.Message{ID: uint64(i + 1), Username: "alice", Content: content, Timestamp: now}
+			if err := s.AppendMessage("books", msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.UpdateMessage("books", &models.Message{ID: 2, Username: "alice", Deleted: true, Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateMessage("books", &models.Message{ID: 9}); err != ErrMessageNotFound {
+			t.Errorf("updating a missing message: got %v, want %v", err, ErrMessageNotFound)
+		}
+		s = b.reopen(t, s)
+
+		messages, err := s.Messages("books")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			content string
+			deleted bool
+		}{{"first", false}, {"", true}, {"third", false}}
+		if len(messages) != len(want) {
+			t.Fatalf("got %d messages, want %d", len(messages), len(want))
+		}
+		for i, msg := range messages {
+			if msg.ID != uint64(i+1) || msg.Content != want[i].content || msg.Deleted != want[i].deleted || !msg.Timestamp.Equal(now) {
+				t.Errorf("message %d: got %+v, want content %q, deleted %v", i+1, msg, want[i].content, want[i].deleted)
+			}
+		}
+	})
+}
+
+func TestRenameAndDeleteRoom(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		for _, name := range []string{"books", "films"} {
+			if err := s.SaveRoom(testRecord(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.AppendMessage("books", &models.Message{ID: 1, Content: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RenameRoom("books", "films"); err != ErrRoomExists {
+			t.Errorf("renaming to a taken name: got %v, want %v", err, ErrRoomExists)
+		}
+		if err := s.RenameRoom("missing", "novels"); err != ErrRoomNotFound {
+			t.Errorf("renaming a missing room: got %v, want %v", err, ErrRoomNotFound)
+		}
+		if err := s.RenameRoom("books", "novels"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteRoom("films"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteRoom("films"); err != ErrRoomNotFound {
+			t.Errorf("deleting a missing room: got %v, want %v", err, ErrRoomNotFound)
+		}
+		s = b.reopen(t, s)
+
+		rooms, err := s.Rooms()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 || rooms[0].Name != "novels" {
+			t.Fatalf("got rooms %+v, want only novels", rooms)
+		}
+		messages, err := s.Messages("novels")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Content != "hello" {
+			t.Errorf("got messages %+v, want the history of books", messages)
+		}
+		if _, err := s.Messages("books"); err != ErrRoomNotFound {
+			t.Errorf("messages of the old name: got %v, want %v", err, ErrRoomNotFound)
+		}
+	})
+}
+
+func TestUsersRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		user := &models.User{Username: "alice", PasswordHash: "hash", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+		if err := s.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateUser(&models.User{Username: "alice"}); err != ErrUserExists {
+			t.Errorf("creating a taken username: got %v, want %v", err, ErrUserExists)
+		}
+		s = b.reopen(t, s)
+
+		got, err := s.User("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Username != user.Username || got.PasswordHash != user.PasswordHash || !got.CreatedAt.Equal(user.CreatedAt) {
+			t.Errorf("got %+v, want %+v", got, user)
+		}
+		if _, err := s.User("bob"); err != ErrUserNotFound {
+			t.Errorf("looking up a missing user: got %v, want %v", err, ErrUserNotFound)
+		}
+	})
+}
+
+func TestRevokedTokensRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		if err := s.RevokeToken("used", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		s = b.reopen(t, s)
+
+		for id, want := range map[string]bool{"used": true, "fresh": false} {
+			revoked, err := s.IsRevoked(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != want {
+				t.Errorf("%s: got revoked %v, want %v", id, revoked, want)
+			}
+		}
+	})
+}
+
+func TestExpiredRevocationsArePruned(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := b.open(t)
+		if err := s.RevokeToken("expired", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RevokeToken("valid", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		// Revoking another token prunes the revocations that have expired since.
+		if err := s.RevokeToken("other", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		for id, want := range map[string]bool{"expired": false, "valid": true, "other": true} {
+			revoked, err := s.IsRevoked(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != want {
+				t.Errorf("%s: got revoked %v, want %v", id, revoked, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,28 @@
+const API_URL = "http://12.12.12.10:8080";
+
+let postForm = (path, fields) => fetch(`${API_URL}${path}`, {
+    method: "POST",
+    credentials: "include",
+    body: new URLSearchParams(fields),
+});
+
+// login opens a session for the user, registering the account first if it does not exist yet
+let login = async (username, password) => {
+    let response = await postForm("/users/login", { username, password });
+    if (response.status === 401) {
+        const registration = await postForm("/users/register", { username, password });
+        if (!registration.ok) {
+            throw new Error(await registration.text());
+        }
+        response = await postForm("/users/login", { username, password });
+    }
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+
+    return response.json();
+};
+
+let logout = () => postForm("/users/logout", {});
+
+export { login, logout };
@@ -0,0 +1,43 @@
+const API_URL = "http://12.12.12.10:8080";
+
+// openDirectConversation starts the conversation with user, or returns the existing one
+let openDirectConversation = async user => {
+    const response = await fetch(`${API_URL}/dms`, {
+        method: "POST",
+        credentials: "include",
+        body: new URLSearchParams({ user }),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+
+    return response.json();
+};
+
+// openGroupConversation starts a conversation with users
+let openGroupConversation = async users => {
+    const body = new URLSearchParams();
+    users.forEach(user => body.append("user", user));
+    const response = await fetch(`${API_URL}/dms`, {
+        method: "POST",
+        credentials: "include",
+        body,
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+
+    return response.json();
+};
+
+// listDirectConversations returns the direct and group conversations of the logged in user, newest activity first
+let listDirectConversations = async () => {
+    const response = await fetch(`${API_URL}/dms`, { credentials: "include" });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+
+    return response.json();
+};
+
+export { openDirectConversation, openGroupConversation, listDirectConversations };
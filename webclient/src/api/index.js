@@ -1,7 +1,16 @@
 var socket;
+var listeners = [];
 
-let connect = (cb, username) => {
-    socket = new WebSocket(`ws://12.12.12.10:8080/?username=${username}`);
+// connect opens the lobby socket, which pushes room and presence events, and passes every event to
+// cb and to the subscribers
+let connect = (cb) => {
+    if (cb) {
+        listeners.push(cb);
+    }
+    if (socket) {
+        return;
+    }
+    socket = new WebSocket(`ws://12.12.12.10:8080/`);
 
     socket.onopen = () => {
         console.log("Successfully Connected");
@@ -9,11 +18,13 @@ let connect = (cb, username) => {
 
     socket.onmessage = msg => {
         console.log(msg);
-        cb(JSON.parse(msg.data));
+        const event = JSON.parse(msg.data);
+        listeners.forEach(listener => listener(event));
     };
 
     socket.onclose = event => {
         console.log("Socket Closed Connection: ", event);
+        socket = undefined;
     };
 
     socket.onerror = error => {
@@ -21,9 +32,17 @@ let connect = (cb, username) => {
     };
 };
 
+// subscribe passes the lobby events to cb until the returned function is called
+let subscribe = cb => {
+    listeners.push(cb);
+    return () => {
+        listeners = listeners.filter(listener => listener !== cb);
+    };
+};
+
 let sendMsg = msg => {
     console.log("sending msg: ", msg);
     socket.send(msg);
 };
 
-export { connect, sendMsg };
\ No newline at end of file
+export { connect, subscribe, sendMsg };
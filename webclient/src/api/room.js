@@ -1,8 +1,15 @@
+// Version of the envelope protocol spoken over room sockets
+const PROTOCOL_VERSION = 1;
+
 var roomSocket;
+var currentRoom;
+var nextId = 0;
 
-let connectRoom = (cb, roomName, username) => {
+// connectRoom opens the room socket; the server identifies the user by the session cookie
+let connectRoom = (cb, roomName) => {
     console.log(`connecting to room ${roomName}`);
-    roomSocket = new WebSocket(`ws://12.12.12.10:8080/rooms/${roomName}?username=${username}`);
+    currentRoom = roomName;
+    roomSocket = new WebSocket(`ws://12.12.12.10:8080/rooms/${encodeURIComponent(roomName)}`);
 
     roomSocket.onopen = () => {
         console.log("Successfully Connected");
@@ -10,7 +17,11 @@ let connectRoom = (cb, roomName, username) => {
 
     roomSocket.onmessage = msg => {
         console.log(msg);
-        cb(JSON.parse(msg.data));
+        const envelope = JSON.parse(msg.data);
+        if (envelope.type === "error") {
+            console.log("Server rejected envelope: ", envelope);
+        }
+        cb(envelope);
     };
 
     roomSocket.onclose = event => {
@@ -22,9 +33,34 @@ let connectRoom = (cb, roomName, username) => {
     };
 };
 
+let sendEnvelope = (type, payload) => {
+    const envelope = {
+        v: PROTOCOL_VERSION,
+        type: type,
+        id: `c-${++nextId}`,
+        room: currentRoom,
+        payload: payload,
+    };
+    console.log("sending envelope: ", envelope);
+    roomSocket.send(JSON.stringify(envelope));
+
+    return envelope.id;
+};
+
+// sendMsg sends a chat message and returns the nonce the server will echo back with it
 let sendMsg = msg => {
-    console.log("sending msg: ", msg);
-    roomSocket.send(msg);
+    const nonce = `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+    sendEnvelope("chat", { content: msg, nonce: nonce });
+
+    return nonce;
 };
 
-export { connectRoom, sendMsg };
\ No newline at end of file
+let sendEdit = (messageId, content) => sendEnvelope("edit", { message_id: messageId, content: content });
+
+let sendDelete = messageId => sendEnvelope("delete", { message_id: messageId });
+
+let sendReaction = (messageId, emoji, remove) => sendEnvelope("reaction", { message_id: messageId, emoji: emoji, remove: remove });
+
+let sendTyping = typing => sendEnvelope("typing", { typing: typing });
+
+export { connectRoom, sendMsg, sendEdit, sendDelete, sendReaction, sendTyping };
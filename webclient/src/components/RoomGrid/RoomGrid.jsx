@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from 'react';
+import { subscribe } from '../../api/index';
 
 import './RoomGrid.css';
 
@@ -9,7 +10,7 @@ const RoomGrid = () => {
     useEffect(() => {
         const fetchData = async () => {
             try {
-                const response = await fetch('http://12.12.12.10:8080/rooms');
+                const response = await fetch('http://12.12.12.10:8080/rooms', { credentials: "include" });
                 const result = await response.json();
                 console.log(result)
                 setData(result);
@@ -19,6 +20,28 @@ const RoomGrid = () => {
         };
 
         fetchData();
+
+        // The lobby keeps the directory and the member counts up to date.
+        return subscribe((event) => {
+            switch (event.type) {
+                case "room_created":
+                    setData(rooms => ({ ...rooms, [event.room]: event.payload }));
+                    break;
+                case "room_deleted":
+                    setData(rooms => {
+                        const { [event.room]: _, ...others } = rooms;
+                        return others;
+                    });
+                    break;
+                case "room_occupancy":
+                    setData(rooms => rooms[event.room] ? {
+                        ...rooms,
+                        [event.room]: { ...rooms[event.room], ClientCount: event.payload.client_count },
+                    } : rooms);
+                    break;
+                default:
+            }
+        });
     }, []);
 
     return (
@@ -29,7 +52,7 @@ const RoomGrid = () => {
             <div className='RoomGrid'>
                 {Object.keys(data).map((roomKey) => (
                     <div onClick={() => {
-                        window.location.href = `/rooms/${roomKey}`;
+                        window.location.href = `/rooms/${encodeURIComponent(roomKey)}`;
                         this.props.navigation.navigate('Details', {
                             roomName: roomKey,
                         });
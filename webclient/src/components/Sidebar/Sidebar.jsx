@@ -1,5 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { sendMsg, connect } from '../../api/index';
+import { login } from '../../api/auth';
+import { openDirectConversation } from '../../api/direct';
 import './Sidebar.scss'
 
 
@@ -7,19 +9,35 @@ const Sidebar = ({ username }) => {
     const [data, setData] = useState([]);
 
     useEffect(() => {
-        const showPrompt = () => {
+        // The lobby announces users going online, away and offline. Away users are still connected.
+        const onLobbyEvent = (event) => {
+            if (event.type !== "presence") {
+                return;
+            }
+            const { username, status } = event.payload;
+            setData(users => {
+                const others = users.filter(user => user !== username);
+                return status === "offline" ? others : [...others, username].sort();
+            });
+        };
+
+        const showPrompt = async () => {
             const username = window.prompt('Username:');
+            const password = window.prompt('Password:');
             console.log("username: " + username)
-            connect((msg) => {
-                console.log("Connecting as " + username)
-
-            }, username);
+            try {
+                await login(username, password);
+            } catch (error) {
+                window.alert(`Login failed: ${error.message}`);
+                return;
+            }
+            connect(onLobbyEvent);
         };
 
 
         const fetchData = async () => {
             try {
-                const response = await fetch('http://12.12.12.10:8080/users');
+                const response = await fetch('http://12.12.12.10:8080/users', { credentials: "include" });
                 const result = await response.json();
                 console.log(result)
                 setData(result);
@@ -31,10 +49,7 @@ const Sidebar = ({ username }) => {
         if (username === null || username === "" || username === undefined) {
             showPrompt();
         } else {
-            connect((msg) => {
-                console.log("Connecting as " + username)
-
-            }, username);
+            connect(onLobbyEvent);
         }
         fetchData();
     }, []);
@@ -45,11 +60,12 @@ const Sidebar = ({ username }) => {
             <ul>
                 {Object.keys(data).map((userKey) => (
                     <div onClick={async () => {
-                        const roomsResponse = await fetch("http://12.12.12.10:8080/rooms")
-                        const roomsResult = await roomsResponse.json();
-
-                        console.log(roomsResult.data)
-                        // window.location.href = `/rooms/Private_${username}_${data[userKey]}`;
+                        try {
+                            const conversation = await openDirectConversation(data[userKey]);
+                            window.location.href = `/rooms/${encodeURIComponent(conversation.name)}`;
+                        } catch (error) {
+                            window.alert(`Could not open conversation: ${error.message}`);
+                        }
                     }
                     } key={userKey} className='rounded-rectangle'>
                         <li key={data[userKey]}>{data[userKey]}</li>
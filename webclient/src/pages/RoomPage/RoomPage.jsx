@@ -2,8 +2,14 @@ import React, { Component } from "react";
 import Header from '../../components/Header/Header';
 import ChatInput from '../../components/ChatInput/ChatInput';
 import Sidebar from "../../components/Sidebar/Sidebar";
+import "./RoomPage.scss";
 
-import { sendMsg, connectRoom } from '../../api/room';
+import { sendMsg, sendTyping, connectRoom } from '../../api/room';
+import { login } from '../../api/auth';
+
+const HISTORY_PAGE_SIZE = 50;
+// How often a typing indicator is renewed while the user keeps typing; the server expires it after 5s
+const TYPING_RENEW_MS = 3000;
 
 class RoomPage extends Component {
     constructor(props) {
@@ -11,9 +17,17 @@ class RoomPage extends Component {
         this.roomName = this.getRoomFromUrl()
         this.state = {
             roomHistory: [],
+            nextCursor: null,
+            isLoadingHistory: false,
+            typingUsers: [],
+            presentUsers: [],
             username: "",
             isPromptCompleted: false,
         }
+        this.historyRef = React.createRef();
+        this.onHistoryScroll = this.onHistoryScroll.bind(this);
+        this.send = this.send.bind(this);
+        this.lastTypingSent = 0;
         // console.log(this.state)
     }
 
@@ -25,39 +39,195 @@ class RoomPage extends Component {
         const segments = pathname.split('/');
 
         // Assuming the structure is always /rooms/{roomName},
-        // the room name should be at index 2
-        const roomName = segments[2];
+        // the URL-encoded room name should be at index 2
+        const roomName = decodeURIComponent(segments[2]);
 
         return roomName;
     };
 
-    async getRoomMessages(roomName) {
-        console.log(`http://12.12.12.10:8080/rooms/${roomName}/messages`)
-        const response = await fetch(`http://12.12.12.10:8080/rooms/${roomName}/messages`);
+    async getRoomMessages(roomName, before) {
+        let url = `http://12.12.12.10:8080/rooms/${encodeURIComponent(roomName)}/messages?limit=${HISTORY_PAGE_SIZE}`;
+        if (before) {
+            url += `&before=${before}`;
+        }
+        console.log(url)
+        const response = await fetch(url, { credentials: "include" });
         const result = await response.json();
 
         return result;
     };
 
+    async loadOlderMessages() {
+        if (!this.state.nextCursor || this.state.isLoadingHistory) {
+            return;
+        }
+        this.setState({ isLoadingHistory: true });
+
+        const history = this.historyRef.current;
+        const previousHeight = history.scrollHeight;
+        const page = await this.getRoomMessages(this.roomName, this.state.nextCursor);
+
+        this.setState((prevState) => ({
+            roomHistory: [...page.messages, ...prevState.roomHistory],
+            nextCursor: page.next_cursor || null,
+            isLoadingHistory: false,
+        }), () => {
+            // Keep the messages that were on screen in place after prepending older ones
+            history.scrollTop = history.scrollHeight - previousHeight;
+        });
+    }
+
+    replaceMessage(msg) {
+        this.setState((prevState) => ({
+            roomHistory: prevState.roomHistory.map(m => m.id === msg.id ? msg : m)
+        }));
+    }
+
+    applyTyping(typing) {
+        if (typing.username === this.state.username) {
+            return;
+        }
+        this.setState((prevState) => {
+            const others = prevState.typingUsers.filter(u => u !== typing.username);
+            return { typingUsers: typing.typing ? [...others, typing.username] : others };
+        });
+    }
+
+    applyPresence(presence) {
+        this.setState((prevState) => {
+            const others = prevState.presentUsers.filter(u => u !== presence.username);
+            return {
+                presentUsers: presence.status === "join" ? [...others, presence.username] : others,
+                typingUsers: presence.status === "leave"
+                    ? prevState.typingUsers.filter(u => u !== presence.username)
+                    : prevState.typingUsers,
+            };
+        });
+    }
+
+    renderTyping() {
+        const users = this.state.typingUsers;
+        if (users.length === 0) {
+            return null;
+        }
+        return <div className="Typing">{users.join(", ")} {users.length === 1 ? "is" : "are"} typing...</div>;
+    }
+
+    applyReaction(reaction) {
+        this.setState((prevState) => ({
+            roomHistory: prevState.roomHistory.map(m => {
+                if (m.id !== reaction.message_id) {
+                    return m;
+                }
+                const reactions = { ...(m.reactions || {}) };
+                const users = (reactions[reaction.emoji] || []).filter(u => u !== reaction.username);
+                if (!reaction.remove) {
+                    users.push(reaction.username);
+                }
+                if (users.length === 0) {
+                    delete reactions[reaction.emoji];
+                } else {
+                    reactions[reaction.emoji] = users;
+                }
+                return { ...m, reactions: reactions };
+            })
+        }));
+    }
+
+    renderReactions(msg) {
+        return Object.entries(msg.reactions || {}).map(([emoji, users]) => (
+            <span className="Reaction" key={emoji} title={users.join(", ")}>
+                {emoji} {users.length}
+            </span>
+        ));
+    }
+
+    renderContent(msg) {
+        if (msg.deleted) {
+            return <i>message deleted</i>;
+        }
+        const content = msg.edited_at ? `${msg.content} (edited)` : msg.content;
+        if (msg.reply_count) {
+            return `${content} [${msg.reply_count} ${msg.reply_count === 1 ? "reply" : "replies"}]`;
+        }
+        return content;
+    }
+
+    onHistoryScroll(event) {
+        if (event.target.scrollTop === 0) {
+            this.loadOlderMessages();
+        }
+    }
+
 
     async showPrompt() {
         const username = window.prompt('Username:');
+        const password = window.prompt('Password:');
         console.log("username: " + username)
 
-        const roomHistory = await this.getRoomMessages(this.roomName)
+        try {
+            await login(username, password);
+        } catch (error) {
+            window.alert(`Login failed: ${error.message}`);
+            return;
+        }
 
-        this.state.roomHistory = roomHistory
+        const page = await this.getRoomMessages(this.roomName)
 
-        this.setState({ username: username, isPromptCompleted: true }, () => {
+        this.setState({
+            roomHistory: page.messages,
+            nextCursor: page.next_cursor || null,
+            username: username,
+            isPromptCompleted: true,
+        }, () => {
+            const history = this.historyRef.current;
+            history.scrollTop = history.scrollHeight;
             console.log("Connecting as " + username)
-            connectRoom((msg) => {
+            connectRoom((envelope) => {
+                if (envelope.type === "edit" || envelope.type === "delete") {
+                    this.replaceMessage(envelope.payload);
+                    return;
+                }
+                if (envelope.type === "reaction") {
+                    this.applyReaction(envelope.payload);
+                    return;
+                }
+                if (envelope.type === "typing") {
+                    this.applyTyping(envelope.payload);
+                    return;
+                }
+                if (envelope.type === "presence") {
+                    this.applyPresence(envelope.payload);
+                    return;
+                }
+                if (envelope.type !== "chat") {
+                    return;
+                }
                 console.log("New Message")
-                this.setState((prevState) => ({
-                    roomHistory: [...this.state.roomHistory, msg]
-                }))
+                const msg = envelope.payload;
+                if (msg.parent_id) {
+                    // Replies live in their thread; the main stream only shows the reply count
+                    this.setState((prevState) => ({
+                        roomHistory: prevState.roomHistory.map(m => m.id === msg.parent_id
+                            ? { ...m, reply_count: (m.reply_count || 0) + 1 }
+                            : m)
+                    }));
+                    return;
+                }
+                this.setState((prevState) => {
+                    // Replace our optimistic local copy once the server broadcasts it back
+                    const pending = prevState.roomHistory.findIndex(m =>
+                        m.pending && m.nonce === msg.nonce && m.username === msg.username);
+                    if (pending === -1) {
+                        return { roomHistory: [...prevState.roomHistory, msg] };
+                    }
+                    const roomHistory = [...prevState.roomHistory];
+                    roomHistory[pending] = msg;
+                    return { roomHistory: roomHistory };
+                })
                 console.log(this.state);
 
-            }, "Global", username);
+            }, this.roomName);
         });
     }
 
@@ -66,10 +236,31 @@ class RoomPage extends Component {
     }
 
     send(event) {
-        if (event.keyCode === 13) {
-            sendMsg(event.target.value);
-            event.target.value = "";
+        if (event.keyCode !== 13) {
+            const now = Date.now();
+            if (now - this.lastTypingSent > TYPING_RENEW_MS) {
+                sendTyping(true);
+                this.lastTypingSent = now;
+            }
+            return;
         }
+
+        // Sending a message stops the typing indicator on the server
+        this.lastTypingSent = 0;
+        const content = event.target.value;
+        const nonce = sendMsg(content);
+        event.target.value = "";
+
+        this.setState((prevState) => ({
+            roomHistory: [...prevState.roomHistory, {
+                id: `pending-${nonce}`,
+                username: prevState.username,
+                content: content,
+                timestamp: new Date().toISOString(),
+                nonce: nonce,
+                pending: true,
+            }]
+        }));
     }
 
     render() {
@@ -84,13 +275,17 @@ class RoomPage extends Component {
                 <Sidebar username={this.state.username} />
 
                 <h2>Room Global</h2>
-                {this.state.roomHistory.map(msg => {
-                    return (
-                        <div className="Message">
-                            [{msg.timestamp}] {msg.username}: {msg.content}
-                        </div>
-                    )
-                })}
+                <div className="RoomHistory" ref={this.historyRef} onScroll={this.onHistoryScroll}>
+                    {this.state.roomHistory.map(msg => {
+                        return (
+                            <div className={msg.pending ? "Message pending" : "Message"} key={msg.id}>
+                                [{new Date(msg.timestamp).toLocaleString()}] {msg.username}: {this.renderContent(msg)} {this.renderReactions(msg)}
+                            </div>
+                        )
+                    })}
+                </div>
+                <div className="Presence">Online: {this.state.presentUsers.join(", ")}</div>
+                {this.renderTyping()}
                 <ChatInput send={this.send} />
             </div>
         );